@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	defaultSyncAnnotation  = "eightypercent.net/secretsync"
+	defaultSourceNamespace = "secretsync"
+)
+
+var defaultNamespaceBlacklist = []string{
+	"kube-public",
+	"kube-system",
+}
+
+// syncConfig is everything that decides what gets synced where.  Running
+// several instances of the controller side by side (one per team, say) works
+// as long as each one has its own source namespace or annotation.
+type syncConfig struct {
+	// SourceNamespace is where the objects to copy live.  It is never a
+	// target itself.  Policies and the leader lease live here too.
+	SourceNamespace string `json:"sourceNamespace"`
+	// SourceNamespaces, if set, are the namespaces objects get copied from
+	// instead of just SourceNamespace.  Later namespaces take precedence
+	// over earlier ones, so list platform-wide ones first and more specific
+	// ones after.  When two of them have an object of the same kind and name
+	// only the one from the later namespace gets copied.
+	SourceNamespaces []string `json:"sourceNamespaces"`
+	// Annotation marks source objects and opted in namespaces.  The
+	// annotations we stamp on copies use it as a prefix.
+	Annotation string `json:"annotation"`
+	// NamespaceBlacklist and NamespaceWhitelist are lists of glob patterns
+	// (as in path.Match) matched against namespace names.  A namespace is a
+	// possible target if it matches the whitelist (or the whitelist is empty)
+	// and doesn't match the blacklist.
+	NamespaceBlacklist []string `json:"namespaceBlacklist"`
+	NamespaceWhitelist []string `json:"namespaceWhitelist"`
+	// Kinds are the kinds of objects to replicate.  See kindConstructors for
+	// what is supported.
+	Kinds []string `json:"kinds"`
+	// RolloutOnChange rolls the Deployments, DaemonSets and StatefulSets
+	// using a synced secret when we update it.  See rollout.go.
+	RolloutOnChange bool `json:"rolloutOnChange"`
+	// AdoptExisting treats every copy made before provenance was stamped as
+	// ours, so they get updated and pruned.  See provenance.go.
+	AdoptExisting bool `json:"adoptExisting"`
+}
+
+func defaultSyncConfig() syncConfig {
+	return syncConfig{
+		SourceNamespace:    defaultSourceNamespace,
+		Annotation:         defaultSyncAnnotation,
+		NamespaceBlacklist: defaultNamespaceBlacklist,
+		Kinds:              defaultKinds,
+	}
+}
+
+// loadSyncConfigFile reads a YAML or JSON file on top of cfg.  Fields that
+// aren't in the file keep their current value.
+func loadSyncConfigFile(filename string, cfg *syncConfig) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("error parsing %v: %v", filename, err)
+	}
+	return nil
+}
+
+func (cfg *syncConfig) validate() error {
+	if cfg.SourceNamespace == "" {
+		return fmt.Errorf("source namespace must not be empty")
+	}
+	seen := map[string]bool{}
+	for _, ns := range cfg.SourceNamespaces {
+		if seen[ns] {
+			return fmt.Errorf("source namespace %q listed twice", ns)
+		}
+		seen[ns] = true
+	}
+	for _, key := range []string{cfg.Annotation, cfg.sourceNamespaceAnnotation()} {
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			return fmt.Errorf("invalid annotation %q: %v", key, strings.Join(errs, "; "))
+		}
+	}
+	for _, kind := range cfg.Kinds {
+		if _, ok := kindConstructors[kind]; !ok {
+			return fmt.Errorf("unsupported kind %q, must be one of %v", kind, strings.Join(supportedKinds(), ", "))
+		}
+	}
+	for _, pattern := range append(cfg.NamespaceBlacklist, cfg.NamespaceWhitelist...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// sourceNamespaces returns the namespaces to copy from, lowest precedence
+// first.
+func (cfg *syncConfig) sourceNamespaces() []string {
+	if len(cfg.SourceNamespaces) == 0 {
+		return []string{cfg.SourceNamespace}
+	}
+	return cfg.SourceNamespaces
+}
+
+func (cfg *syncConfig) isSourceNamespace(name string) bool {
+	for _, ns := range cfg.sourceNamespaces() {
+		if ns == name {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceAllowed applies the source namespace exclusion and the white and
+// black lists.  It doesn't look at the opt-in annotation.
+func (cfg *syncConfig) namespaceAllowed(name string) bool {
+	if cfg.isSourceNamespace(name) || name == cfg.SourceNamespace {
+		return false
+	}
+	if len(cfg.NamespaceWhitelist) != 0 && !matchesAny(cfg.NamespaceWhitelist, name) {
+		return false
+	}
+	return !matchesAny(cfg.NamespaceBlacklist, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// Patterns are checked in validate so errors can't happen here.
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stringListFlag is a comma separated list flag.
+type stringListFlag struct {
+	list *[]string
+}
+
+func (f stringListFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f stringListFlag) Set(value string) error {
+	*f.list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f.list = append(*f.list, item)
+		}
+	}
+	return nil
+}
+
+// addSyncConfigFlags registers flags for cfg.  Flags win over the config file
+// so they are applied again after the file is loaded.
+func addSyncConfigFlags(fs *flag.FlagSet, cfg *syncConfig) {
+	fs.StringVar(&cfg.SourceNamespace, "source-namespace", cfg.SourceNamespace, "namespace to copy objects from and to read policies from")
+	fs.Var(stringListFlag{&cfg.SourceNamespaces}, "source-namespaces", "comma separated namespaces to copy objects from instead of just --source-namespace; later ones win over earlier ones")
+	fs.StringVar(&cfg.Annotation, "annotation", cfg.Annotation, "annotation marking source objects and target namespaces")
+	fs.Var(stringListFlag{&cfg.NamespaceBlacklist}, "namespace-blacklist", "comma separated glob patterns of namespaces never to sync to")
+	fs.Var(stringListFlag{&cfg.NamespaceWhitelist}, "namespace-whitelist", "comma separated glob patterns of namespaces to limit syncing to; empty means all")
+	fs.Var(stringListFlag{&cfg.Kinds}, "kinds", "comma separated kinds of objects to replicate, any of "+strings.Join(supportedKinds(), ", "))
+	fs.BoolVar(&cfg.AdoptExisting, "adopt-existing", cfg.AdoptExisting, "take over every object in a target namespace carrying the annotation but no provenance, as copies made by older versions do")
+	fs.BoolVar(&cfg.RolloutOnChange, "rollout-on-change", cfg.RolloutOnChange, "roll Deployments, DaemonSets and StatefulSets using a synced secret when it changes")
+}
@@ -2,18 +2,20 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	informercorev1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	listercorev1 "k8s.io/client-go/listers/core/v1"
 	apicorev1 "k8s.io/client-go/pkg/api/v1"
@@ -21,132 +23,265 @@ import (
 	"k8s.io/client-go/util/workqueue"
 )
 
-const (
-	secretSyncAnnotation      = "eightypercent.net/secretsync"
-	secretSyncSourceNamespace = "secretsync"
-	secretSyncKey             = "do it"
-)
+// workItem is what goes on the queue.  An item with just a Namespace means
+// "reconcile everything in this namespace" while one with a Kind and Name
+// means "reconcile just this one object in this namespace".
+type workItem struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
 
-var namespaceBlacklist = map[string]bool{
-	"kube-public":             true,
-	"kube-system":             true,
-	secretSyncSourceNamespace: true,
+func (w workItem) String() string {
+	if w.Kind == "" {
+		return w.Namespace
+	}
+	return fmt.Sprintf("%v %v/%v", w.Kind, w.Namespace, w.Name)
 }
 
+// defaultShutdownGracePeriod is how long workers get to finish the item
+// they're on when we're told to stop.
+const defaultShutdownGracePeriod = 30 * time.Second
+
 type TGIKController struct {
-	secretGetter          corev1.SecretsGetter
-	secretLister          listercorev1.SecretLister
-	secretListerSynced    cache.InformerSynced
+	config syncConfig
+	// shutdownGracePeriod bounds how long Run waits for workers on the way
+	// out.
+	shutdownGracePeriod time.Duration
+
+	// kinds are the kinds of objects we replicate, in the order we sync them.
+	kinds       []*kindAdapter
+	kindsByName map[string]*kindAdapter
+
 	namespaceGetter       corev1.NamespacesGetter
 	namespaceLister       listercorev1.NamespaceLister
 	namespaceListerSynced cache.InformerSynced
 
-	queue workqueue.RateLimitingInterface
+	// Policies are ConfigMaps so they come from the ConfigMap informer
+	// whether or not we replicate ConfigMaps.
+	configMapGetter    corev1.ConfigMapsGetter
+	policyLister       listercorev1.ConfigMapLister
+	policyListerSynced cache.InformerSynced
+	policies           *policyCache
+	policyStatus       *policyStatusTracker
+
+	queue    workqueue.RateLimitingInterface
+	health   *healthChecker
+	recorder *eventRecorder
+	writer   objectWriter
+	// rollouts is nil unless workloads get rolled on secret changes.
+	rollouts *workloadRoller
+	// dryRun is set when writer only records what it would do.  We don't
+	// touch the cluster at all then, so no events and no policy status.
+	dryRun bool
 }
 
 func NewTGIKController(client *kubernetes.Clientset,
-	secretInformer informercorev1.SecretInformer,
-	namespaceInformer informercorev1.NamespaceInformer) *TGIKController {
+	kinds []*kindAdapter,
+	namespaceInformer informercorev1.NamespaceInformer,
+	configMapInformer informercorev1.ConfigMapInformer,
+	config syncConfig) *TGIKController {
 	c := &TGIKController{
-		secretGetter:          client.CoreV1(),
-		secretLister:          secretInformer.Lister(),
-		secretListerSynced:    secretInformer.Informer().HasSynced,
+		config:                config,
+		shutdownGracePeriod:   defaultShutdownGracePeriod,
+		kinds:                 kinds,
+		kindsByName:           map[string]*kindAdapter{},
 		namespaceGetter:       client.CoreV1(),
 		namespaceLister:       namespaceInformer.Lister(),
 		namespaceListerSynced: namespaceInformer.Informer().HasSynced,
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "secretsync"),
+		configMapGetter:       client.CoreV1(),
+		policyLister:          configMapInformer.Lister(),
+		policyListerSynced:    configMapInformer.Informer().HasSynced,
+		policies:              newPolicyCache(),
+		policyStatus:          newPolicyStatusTracker(),
+		queue:                 workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "secretsync"),
+		health:                newHealthChecker(defaultStuckWorkerThreshold),
+		recorder:              newEventRecorder(client.CoreV1(), controllerName),
+		writer:                apiWriter{},
 	}
 
-	// TODO: only schedule sync if it is a secret that has or had our
-	// annotation.
-	secretInformer.Informer().AddEventHandler(
+	for _, kind := range kinds {
+		kind := kind
+		c.kindsByName[kind.Kind] = kind
+		kind.Informer.AddEventHandler(
+			cache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) {
+					if !c.objectIsRelevant(kind.Kind, obj) {
+						return
+					}
+					logger.debug("object added", "kind", kind.Kind, "object", obj)
+					c.enqueueObject(kind.Kind, obj)
+				},
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					if !c.objectUpdateIsRelevant(kind.Kind, oldObj, newObj) {
+						return
+					}
+					logger.debug("object updated", "kind", kind.Kind, "object", newObj)
+					c.enqueueObject(kind.Kind, newObj)
+				},
+				DeleteFunc: func(obj interface{}) {
+					if !c.objectIsRelevant(kind.Kind, obj) {
+						return
+					}
+					logger.debug("object deleted", "kind", kind.Kind, "object", unwrapTombstone(obj))
+					c.enqueueObject(kind.Kind, obj)
+				},
+			},
+		)
+	}
+
+	// There is no DeleteFunc here on purpose.  When a namespace goes away
+	// Kubernetes takes our copies with it so there is nothing left to do.
+	namespaceInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				log.Print("secret added")
-				c.ScheduleSecretSync()
+				if !c.namespaceIsRelevant(obj) {
+					return
+				}
+				logger.debug("namespace added", "namespace", obj)
+				c.enqueueNamespace(obj)
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				log.Print("secret updated")
-				c.ScheduleSecretSync()
-			},
-			DeleteFunc: func(obj interface{}) {
-				log.Print("secret deleted")
-				c.ScheduleSecretSync()
+				if !c.namespaceUpdateIsRelevant(oldObj, newObj) {
+					return
+				}
+				logger.debug("namespace updated", "namespace", newObj)
+				c.enqueueNamespace(newObj)
 			},
 		},
 	)
 
-	// TODO: only schedule sync if it is a namespace that has or had our
-	// annotation or the secretsync source namespace.
-	namespaceInformer.Informer().AddEventHandler(
+	configMapInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				log.Print("namespace added")
-				c.ScheduleSecretSync()
+				if !c.policyIsRelevant(obj) {
+					return
+				}
+				logger.debug("policy added", "kind", policyKind, "policy", obj)
+				c.enqueuePolicy(obj)
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				log.Print("namespace updated")
-				c.ScheduleSecretSync()
+				if !c.policyUpdateIsRelevant(oldObj, newObj) {
+					return
+				}
+				logger.debug("policy updated", "kind", policyKind, "policy", newObj)
+				c.enqueuePolicy(newObj)
 			},
 			DeleteFunc: func(obj interface{}) {
-				log.Print("namespace deleted")
-				c.ScheduleSecretSync()
+				if !c.policyIsRelevant(obj) {
+					return
+				}
+				logger.debug("policy deleted", "kind", policyKind, "policy", unwrapTombstone(obj))
+				c.enqueuePolicy(obj)
 			},
 		},
 	)
 	return c
 }
 
-func (c *TGIKController) Run(stop <-chan struct{}) {
+// enableDryRun hands all writes to w, which is expected to only record
+// them.  It has to be called before Run.
+func (c *TGIKController) enableDryRun(w objectWriter) {
+	c.dryRun = true
+	c.writer = w
+	c.recorder = nil
+}
+
+// Run syncs with the given number of workers until stop is closed.  The
+// queue never hands the same item to two workers at once, so workers only
+// ever race each other across items.  The API server sorts those races out
+// and the loser retries.
+//
+// Once stop is closed workers finish the item they're on but don't pick up
+// new ones, even though the queue would keep handing out what's left in it.
+// Run returns an error if they take longer than the shutdown grace period.
+func (c *TGIKController) Run(workers int, stop <-chan struct{}) (err error) {
 	var wg sync.WaitGroup
 
 	defer func() {
 		// make sure the work queue is shut down which will trigger workers to end
-		log.Print("shutting down queue")
+		logger.info("shutting down queue")
 		c.queue.ShutDown()
 
-		// wait on the workers
-		log.Print("shutting down workers")
-		wg.Wait()
-
-		log.Print("workers are all done")
+		// wait on the workers, but not forever
+		logger.info("shutting down workers")
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			logger.info("workers are all done")
+		case <-time.After(c.shutdownGracePeriod):
+			err = fmt.Errorf("workers didn't finish within %v", c.shutdownGracePeriod)
+		}
 	}()
 
-	log.Print("waiting for cache sync")
-	if !cache.WaitForCacheSync(
-		stop,
-		c.secretListerSynced,
-		c.namespaceListerSynced) {
-		log.Print("timed out waiting for cache sync")
-		return
+	if !c.waitForCacheSync(stop) {
+		return nil
+	}
+	if !c.dryRun {
+		go c.recorder.run(stop)
+		go wait.Until(c.writePolicyStatus, policyStatusInterval, stop)
+	}
+	defer c.health.setReady(false)
+
+	logger.info("starting workers", "workers", workers)
+	for i := 0; i < workers; i++ {
+		// Add before starting the goroutine so the deferred Wait can't miss
+		// a worker that hasn't been scheduled yet.
+		wg.Add(1)
+		go func() {
+			// tell the WaitGroup this worker is done
+			defer wg.Done()
+			// runWorker will loop until "something bad" happens. wait.Until
+			// will then rekick the worker after one second.
+			wait.Until(func() { c.runWorker(stop) }, time.Second, stop)
+		}()
 	}
-	log.Print("caches are synced")
-
-	go func() {
-		// runWorker will loop until "something bad" happens. wait.Until will
-		// then rekick the worker after one second.
-		wait.Until(c.runWorker, time.Second, stop)
-		// tell the WaitGroup this worker is done
-		wg.Done()
-	}()
 
 	// wait until we're told to stop
-	log.Print("waiting for stop signal")
+	logger.info("waiting for stop signal")
 	<-stop
-	log.Print("received stop signal")
+	logger.info("received stop signal")
+	return nil
+}
+
+// waitForCacheSync waits for all of our informers and marks us ready once
+// they have synced.  Readiness only says the caches are warm, not that we
+// lead, so with leader election main calls this before campaigning and
+// standby replicas become ready too.  It returns false if stop was closed
+// first.
+func (c *TGIKController) waitForCacheSync(stop <-chan struct{}) bool {
+	logger.info("waiting for cache sync")
+	synced := []cache.InformerSynced{c.namespaceListerSynced, c.policyListerSynced}
+	for _, kind := range c.kinds {
+		synced = append(synced, kind.Informer.HasSynced)
+	}
+	if c.rollouts != nil {
+		synced = append(synced, c.rollouts.synced...)
+	}
+	if !cache.WaitForCacheSync(stop, synced...) {
+		logger.warn("stopped before caches synced")
+		return false
+	}
+	logger.info("caches are synced")
+	c.health.setReady(true)
+	return true
 }
 
-func (c *TGIKController) runWorker() {
+func (c *TGIKController) runWorker(stop <-chan struct{}) {
 	// hot loop until we're told to stop.  processNextWorkItem will
 	// automatically wait until there's work available, so we don't worry
 	// about secondary waits
-	for c.processNextWorkItem() {
+	for c.processNextWorkItem(stop) {
 	}
 }
 
 // processNextWorkItem deals with one key off the queue.  It returns false
 // when it's time to quit.
-func (c *TGIKController) processNextWorkItem() bool {
+func (c *TGIKController) processNextWorkItem(stop <-chan struct{}) bool {
 	// pull the next work item from queue.  It should be a key we use to lookup
 	// something in a cache
 	key, quit := c.queue.Get()
@@ -157,8 +292,19 @@ func (c *TGIKController) processNextWorkItem() bool {
 	// work
 	defer c.queue.Done(key)
 
+	// After ShutDown the queue still hands out everything that was queued.
+	// Leave those alone, we're on our way out.
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	c.health.startItem(key)
+	defer c.health.finishItem(key)
+
 	// do your work on the key.  This method will contains your "do stuff" logic
-	err := c.doSync()
+	err := c.syncHandler(key.(workItem))
 	if err == nil {
 		// if you had no error, tell the queue to stop tracking history for your
 		// key. This will reset things like failure counts for per-item rate
@@ -167,10 +313,8 @@ func (c *TGIKController) processNextWorkItem() bool {
 		return true
 	}
 
-	// there was a failure so be sure to report it.  This method allows for
-	// pluggable error handling which can be used for things like
-	// cluster-monitoring
-	runtime.HandleError(fmt.Errorf("doSync failed with: %v", err))
+	// there was a failure.  syncHandler already reported it along with the
+	// sync's correlation ID.
 
 	// since we failed, we should requeue the item to work on later.  This
 	// method will add a backoff to avoid hotlooping on particular items
@@ -182,93 +326,569 @@ func (c *TGIKController) processNextWorkItem() bool {
 	return true
 }
 
-func (c *TGIKController) ScheduleSecretSync() {
-	c.queue.Add(secretSyncKey)
+// enqueueObject maps an event for one of our kinds to the work items it
+// affects.  A change to an object in the source namespace fans out to one
+// item per target namespace.  A change anywhere else is a change to (what
+// might be) one of our copies, so we just reconcile that one object.
+func (c *TGIKController) enqueueObject(kind string, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	if !c.config.isSourceNamespace(ns) {
+		c.queue.Add(workItem{Kind: kind, Namespace: ns, Name: name})
+		return
+	}
+
+	targetNamespaces, err := c.getTargetNamespaces()
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, targetNS := range targetNamespaces {
+		c.queue.Add(workItem{Kind: kind, Namespace: targetNS.Name, Name: name})
+	}
 }
 
-func (c *TGIKController) getSecretsInNS(ns string) ([]*apicorev1.Secret, error) {
-	rawSecrets, err := c.secretLister.Secrets(ns).List(labels.Everything())
+// enqueueNamespace schedules a full reconcile of a single namespace.
+func (c *TGIKController) enqueueNamespace(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 	if err != nil {
-		return nil, err
+		runtime.HandleError(err)
+		return
 	}
+	c.queue.Add(workItem{Namespace: key})
+}
 
-	var secrets []*apicorev1.Secret
-	for _, secret := range rawSecrets {
-		if _, ok := secret.Annotations[secretSyncAnnotation]; ok {
-			secrets = append(secrets, secret)
-		}
+// syncHandler dispatches a work item.  Every sync gets its own correlation
+// ID so all of the log lines for it can be found together.
+func (c *TGIKController) syncHandler(item workItem) error {
+	start := time.Now()
+	l := logger.with("sync", newCorrelationID(), "namespace", item.Namespace)
+	if item.Kind != "" {
+		l = l.with("kind", item.Kind, "name", item.Name)
+	}
+	l.debug("sync started")
+
+	var err error
+	metricKind := "Namespace"
+	if item.Kind == "" {
+		err = c.syncNamespace(l, item.Namespace)
+	} else if kind, ok := c.kindsByName[item.Kind]; ok {
+		metricKind = item.Kind
+		err = c.syncObject(l, kind, item.Namespace, item.Name)
+	} else {
+		err = fmt.Errorf("unknown kind %q", item.Kind)
 	}
-	return secrets, nil
+	recordSync(metricKind, item.Namespace, start, err)
+
+	if err != nil {
+		l.error("sync failed", "result", "error", "duration", time.Since(start), "err", err)
+	} else {
+		l.debug("sync finished", "result", "success", "duration", time.Since(start))
+	}
+	return err
 }
 
-func (c *TGIKController) doSync() error {
-	log.Printf("Starting doSync")
-	srcSecrets, err := c.getSecretsInNS(secretSyncSourceNamespace)
+// getObjectsInNS returns the objects of a kind in ns that carry our
+// annotation.
+func (c *TGIKController) getObjectsInNS(kind *kindAdapter, ns string) ([]syncObject, error) {
+	rawObjs, err := kind.list(ns)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var objs []syncObject
+	for _, obj := range rawObjs {
+		if c.config.hasSyncAnnotation(obj) {
+			objs = append(objs, obj)
+		}
 	}
+	return objs, nil
+}
 
+func (c *TGIKController) getTargetNamespaces() ([]*apicorev1.Namespace, error) {
 	rawNamespaces, err := c.namespaceLister.List(labels.Everything())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var targetNamespaces []*apicorev1.Namespace
 	for _, ns := range rawNamespaces {
-		if _, ok := ns.Annotations[secretSyncAnnotation]; ok {
+		if c.isTargetNamespace(ns) {
 			targetNamespaces = append(targetNamespaces, ns)
 		}
 	}
+	return targetNamespaces, nil
+}
 
-	for _, ns := range targetNamespaces {
-		c.SyncNamespace(srcSecrets, ns.Name)
+// isTargetNamespace returns true for namespaces that opted in with the
+// annotation or that a policy selects.
+func (c *TGIKController) isTargetNamespace(ns *apicorev1.Namespace) bool {
+	if !c.config.namespaceAllowed(ns.Name) {
+		return false
 	}
+	return c.config.hasSyncAnnotation(ns) || len(c.policiesForNamespace(ns)) != 0
+}
 
-	log.Print("Finishing doSync")
-	return err
+// lookupNamespace returns nil if the namespace doesn't exist (anymore) or is
+// one we must never touch.  Namespaces that aren't targets (anymore) are
+// still returned so the copies we left there get pruned.
+func (c *TGIKController) lookupNamespace(name string) (*apicorev1.Namespace, error) {
+	ns, err := c.namespaceLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !c.config.namespaceAllowed(ns.Name) {
+		return nil, nil
+	}
+	return ns, nil
 }
 
-func (c *TGIKController) SyncNamespace(secrets []*apicorev1.Secret, ns string) {
-	// 1. Create/Update all of the secrets in this namespace
-	for _, secret := range secrets {
-		newSecretInf, _ := scheme.Scheme.DeepCopy(secret)
-		newSecret := newSecretInf.(*apicorev1.Secret)
-		newSecret.Namespace = ns
-		newSecret.ResourceVersion = ""
-		newSecret.UID = ""
-
-		log.Printf("Creating %v/%v", ns, secret.Name)
-		_, err := c.secretGetter.Secrets(ns).Create(newSecret)
-		if apierrors.IsAlreadyExists(err) {
-			log.Printf("Scratch that, updating %v/%v", ns, secret.Name)
-			_, err = c.secretGetter.Secrets(ns).Update(newSecret)
+// desiredObjectsIn is desiredObjects for any namespace.  Nothing is wanted in
+// namespaces that aren't targets: they lost the annotation or the last
+// policy selecting them.
+func (c *TGIKController) desiredObjectsIn(kind *kindAdapter, ns *apicorev1.Namespace) (map[string]*desiredCopy, error) {
+	if !c.isTargetNamespace(ns) {
+		return map[string]*desiredCopy{}, nil
+	}
+	return c.desiredObjects(kind, ns)
+}
+
+func (c *TGIKController) syncNamespace(l *structuredLogger, name string) error {
+	ns, err := c.lookupNamespace(name)
+	if err != nil || ns == nil {
+		return err
+	}
+
+	var errs []error
+	for _, kind := range c.kinds {
+		desired, err := c.desiredObjectsIn(kind, ns)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := c.SyncNamespace(l, kind, desired, ns); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// desiredCopy is one object we want in a target namespace, ready to be
+// written.  If building it failed err says why and obj is nil.
+type desiredCopy struct {
+	// name is the name of the copy, which isn't always the name of its
+	// source.
+	name string
+	// srcs are the sources the copy is made from.  There is more than one
+	// only for composite secrets.
+	srcs []syncObject
+	obj  syncObject
+	hash string
+	// policy is the name of the policy that asked for the copy, if any.
+	policy string
+	// conflicts describe keys that were dropped while merging.
+	conflicts []string
+	err       error
+}
+
+// desiredObjects works out every copy of a kind that should exist in ns,
+// keyed by the name of the copy.  Copies come from annotated source objects
+// if ns opted in, and from the policies selecting ns.  Policies win over
+// annotations.
+func (c *TGIKController) desiredObjects(kind *kindAdapter, ns *apicorev1.Namespace) (map[string]*desiredCopy, error) {
+	desired := map[string]*desiredCopy{}
+	add := func(g *copyGroup) {
+		policy := ""
+		if g.policy != nil {
+			policy = g.policy.Name
 		}
+		// A policy may take over the name from annotated sources but
+		// otherwise the first one to ask for a name gets it.
+		if other, ok := desired[g.name]; ok && (other.policy != "" || policy == "") {
+			runtime.HandleError(fmt.Errorf("both %v %v and %v want to be copied to %v/%v, ignoring %v",
+				kind.Kind, strings.Join(other.sourceNames(), ","), g.srcs[0].GetName(), ns.Name, g.name, g.srcs[0].GetName()))
+			return
+		}
+		if len(g.srcs) > 1 && kind.Kind != "Secret" {
+			runtime.HandleError(fmt.Errorf("only secrets can be merged, copying just %v %v to %v/%v",
+				kind.Kind, g.srcs[0].GetName(), ns.Name, g.name))
+			g.srcs = g.srcs[:1]
+		}
+		desired[g.name] = c.newDesiredCopy(kind, g, ns)
+	}
+
+	if c.config.hasSyncAnnotation(ns) {
+		srcObjs, err := c.getSourcesForNamespace(kind, ns)
 		if err != nil {
-			log.Printf("Error adding secret %v/%v: %v", ns, secret.Name, err)
+			return nil, err
+		}
+		sort.Slice(srcObjs, func(i, j int) bool { return srcObjs[i].GetName() < srcObjs[j].GetName() })
+		for _, g := range c.groupSources(srcObjs, nil) {
+			add(g)
 		}
 	}
 
-	// 2. Delete secrets that have annotation but are not in our src list
-	srcSecrets := sets.String{}
-	targetSecrets := sets.String{}
+	if kind.Kind != "Secret" {
+		return desired, nil
+	}
+	// claimed are the secrets an earlier policy already asked for.
+	claimed := map[string]bool{}
+	for _, p := range c.policiesForNamespace(ns) {
+		var srcObjs []syncObject
+		for _, name := range p.Spec.Secrets {
+			if claimed[name] {
+				continue
+			}
+			src, err := c.getSource(kind, name)
+			if err != nil {
+				return nil, err
+			}
+			if src == nil {
+				continue
+			}
+			claimed[name] = true
+			srcObjs = append(srcObjs, src)
+		}
+		for _, g := range c.groupSources(srcObjs, p) {
+			add(g)
+		}
+	}
+	return desired, nil
+}
 
-	for _, secret := range secrets {
-		srcSecrets.Insert(secret.Name)
+// prepareCopy copies one source into ns with its keys filtered and its
+// templates rendered.
+func (c *TGIKController) prepareCopy(kind *kindAdapter, src syncObject, ns *apicorev1.Namespace, policy *syncPolicy) (syncObject, error) {
+	obj, err := kind.copy(src, ns.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Error copying %v %v/%v: %v", kind.Kind, src.GetNamespace(), src.GetName(), err)
+	}
+	secret, ok := obj.(*apicorev1.Secret)
+	if !ok {
+		return obj, nil
+	}
+	// Any other annotation could be holding secret data, including keys we
+	// are about to filter out, so only ours make it onto the copy.
+	for key := range secret.Annotations {
+		if !c.config.isOurAnnotation(key) {
+			delete(secret.Annotations, key)
+		}
+	}
+	keys := keyFilter{}
+	if policy != nil {
+		keys = policy.Spec.Keys
+	} else if keys, err = c.config.keyFilterFromAnnotations(src); err != nil {
+		return nil, fmt.Errorf("Error copying %v %v/%v: %v", kind.Kind, src.GetNamespace(), src.GetName(), err)
+	}
+	if err := keys.apply(secret); err != nil {
+		return nil, fmt.Errorf("Error copying %v %v/%v: %v", kind.Kind, src.GetNamespace(), src.GetName(), err)
+	}
+	if c.config.isTemplate(src) {
+		if err := renderSecret(secret, ns); err != nil {
+			return nil, fmt.Errorf("Error rendering %v %v/%v: %v", kind.Kind, src.GetNamespace(), src.GetName(), err)
+		}
+	}
+	return obj, nil
+}
+
+func (c *TGIKController) newDesiredCopy(kind *kindAdapter, g *copyGroup, ns *apicorev1.Namespace) *desiredCopy {
+	d := &desiredCopy{
+		name: g.name,
+		srcs: g.srcs,
+	}
+	if g.policy != nil {
+		d.policy = g.policy.Name
+	}
+	first := g.srcs[0]
+	if err := validateTargetName(d.name); err != nil {
+		d.err = fmt.Errorf("Error copying %v %v/%v: %v", kind.Kind, first.GetNamespace(), first.GetName(), err)
+		return d
+	}
+
+	// The first source provides the metadata, the rest only add keys.
+	obj, err := c.prepareCopy(kind, first, ns, g.policy)
+	if err != nil {
+		d.err = err
+		return d
+	}
+	if len(g.srcs) > 1 {
+		secret := obj.(*apicorev1.Secret)
+		owners := map[string]string{}
+		for key := range secret.Data {
+			owners[key] = first.GetName()
+		}
+		for _, src := range g.srcs[1:] {
+			other, err := c.prepareCopy(kind, src, ns, g.policy)
+			if err != nil {
+				d.err = err
+				return d
+			}
+			d.conflicts = append(d.conflicts, mergeSecretData(secret, other.(*apicorev1.Secret), src.GetName(), owners)...)
+		}
+	}
+
+	obj.SetName(d.name)
+	annotations := obj.GetAnnotations()
+	delete(annotations, c.config.hashAnnotation())
+	delete(annotations, c.config.policyAnnotation())
+	c.config.stampProvenance(obj, first)
+	c.config.stampContributors(obj, g.srcs)
+	if g.policy != nil {
+		annotations[c.config.policyAnnotation()] = g.policy.Name
+	}
+	hash, err := c.config.objectHash(obj)
+	if err != nil {
+		d.err = fmt.Errorf("Error hashing %v %v/%v: %v", kind.Kind, ns.Name, d.name, err)
+		return d
+	}
+	annotations[c.config.hashAnnotation()] = hash
+	d.obj = obj
+	d.hash = hash
+	return d
+}
+
+// syncObject reconciles everything name could refer to in ns.  Items for
+// changes in the source namespace carry the name of the source, items for
+// changes to copies the name of the copy, and the two differ when the copy
+// is renamed.
+func (c *TGIKController) syncObject(l *structuredLogger, kind *kindAdapter, nsName, name string) error {
+	ns, err := c.lookupNamespace(nsName)
+	if err != nil || ns == nil {
+		return err
+	}
+
+	desired, err := c.desiredObjectsIn(kind, ns)
+	if err != nil {
+		return err
+	}
+
+	// wasSource catches composites that just lost name as a contributor.
+	wasSource := func(copyName string) bool {
+		existing, err := kind.get(ns.Name, copyName)
+		return err == nil && existing != nil && sets.NewString(c.config.copySourceNames(existing)...).Has(name)
+	}
+
+	var errs []error
+	results := map[string]error{}
+	for _, d := range desired {
+		if d.name != name && !d.hasSource(name) && !wasSource(d.name) {
+			continue
+		}
+		err := c.copyObject(l, kind, d, ns)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, srcName := range d.sourceNames() {
+			results[srcName] = err
+		}
+	}
+	if kind.Kind == "Secret" {
+		c.recordPolicyResults(ns, results, []string{name})
+	}
+
+	// Clean up copies that are no longer wanted: the source is gone, no
+	// longer selects this namespace or its copy got a new name.  A composite
+	// that lost a contributor was rewritten above.
+	existing, err := kind.list(ns.Name)
+	if err != nil {
+		return fmt.Errorf("error listing %v in %v: %v", kind.Resource, ns.Name, err)
+	}
+	for _, obj := range existing {
+		if _, ok := desired[obj.GetName()]; ok {
+			continue
+		}
+		if obj.GetName() != name && !sets.NewString(c.config.copySourceNames(obj)...).Has(name) {
+			continue
+		}
+		if !c.config.isManagedCopy(obj) || !c.mayPrune(obj) {
+			continue
+		}
+		if err := c.deleteObject(l, kind, ns, obj.GetName()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// SyncNamespace makes the copies of one kind in ns match desired.  It carries
+// on past failures so one bad object doesn't hold up the rest, and returns
+// all of the errors at the end so the namespace gets retried.
+func (c *TGIKController) SyncNamespace(l *structuredLogger, kind *kindAdapter, desired map[string]*desiredCopy, ns *apicorev1.Namespace) error {
+	var errs []error
+
+	// 1. Create/Update all of the objects in this namespace
+	results := map[string]error{}
+	for _, d := range desired {
+		err := c.copyObject(l, kind, d, ns)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, srcName := range d.sourceNames() {
+			results[srcName] = err
+		}
+	}
+	if kind.Kind == "Secret" {
+		var names []string
+		for _, p := range c.policiesForNamespace(ns) {
+			names = append(names, p.Spec.Secrets...)
+		}
+		c.recordPolicyResults(ns, results, names)
 	}
 
-	targetSecretList, err := c.getSecretsInNS(ns)
+	// 2. Delete copies we made that we don't want anymore.  Objects that
+	// we didn't create are left alone, and so are copies whose policy asks
+	// to keep them.
+	targetList, err := kind.list(ns.Name)
 	if err != nil {
-		log.Printf("Error listing secrets in %v: %v", ns, err)
+		errs = append(errs, fmt.Errorf("error listing %v in %v: %v", kind.Resource, ns.Name, err))
 	}
-	for _, secret := range targetSecretList {
-		targetSecrets.Insert(secret.Name)
+	for _, obj := range targetList {
+		if _, ok := desired[obj.GetName()]; ok {
+			continue
+		}
+		if !c.config.isManagedCopy(obj) || !c.mayPrune(obj) {
+			continue
+		}
+		if err := c.deleteObject(l, kind, ns, obj.GetName()); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return utilerrors.NewAggregate(errs)
+}
 
-	deleteSet := targetSecrets.Difference(srcSecrets)
-	for secretName, _ := range deleteSet {
-		log.Printf("Delete %v/%v", ns, secretName)
-		err = c.secretGetter.Secrets(ns).Delete(secretName, nil)
+func (c *TGIKController) copyObject(l *structuredLogger, kind *kindAdapter, d *desiredCopy, namespace *apicorev1.Namespace) error {
+	ns := namespace.Name
+	name := d.name
+	// l already has the namespace.  Its name is the one from the work item,
+	// which is the source's for changes in the source namespace.
+	l = l.with("kind", kind.Kind, "copy", name)
+	// Events go on the first source.  For a composite that's the one the
+	// metadata comes from.
+	src := d.srcs[0]
+	srcRef := objectReference(kind, src)
+	srcNames := strings.Join(d.sourceNames(), ",")
+	fail := func(format string, args ...interface{}) error {
+		c.recordCopyEvent(srcRef, namespace, apicorev1.EventTypeWarning, reasonSyncFailed, format, args...)
+		return fmt.Errorf(format, args...)
+	}
+	recordConflicts := func() {
+		for _, conflict := range d.conflicts {
+			c.recordCopyEvent(srcRef, namespace, apicorev1.EventTypeWarning, reasonConflict, "Merging into %v %v/%v: %v", kind.Kind, ns, name, conflict)
+		}
+	}
+	if d.err != nil {
+		return fail("%v", d.err)
+	}
+	newObj := d.obj
+
+	existing, err := kind.get(ns, name)
+	if err != nil {
+		return fail("Error getting %v %v/%v: %v", kind.Kind, ns, name, err)
+	}
+	if existing != nil {
+		if c.mayAdopt(existing, d) {
+			l.info("adopting copy made before provenance was stamped", "action", "adopt")
+		} else if !c.config.isOwnedCopy(existing) {
+			l.warn("not overwriting object we didn't create", "action", "skip", "result", "conflict")
+			c.recordCopyEvent(srcRef, namespace, apicorev1.EventTypeWarning, reasonConflict, "Not overwriting %v %v/%v, it wasn't created by %v", kind.Kind, ns, name, controllerName)
+			// Retrying won't help until somebody deletes or renames theirs.
+			return nil
+		}
+		if c.config.upToDate(existing, newObj, d.hash) {
+			// Still check the workloads in case rolling them failed last
+			// time.
+			return c.rollWorkloads(l, kind, namespace, name, d.hash, false)
+		}
+		newObj.SetResourceVersion(existing.GetResourceVersion())
+		err = c.writer.update(kind, newObj)
+		logWrite(l, "update", err)
 		if err != nil {
-			log.Printf("Error deleting %v/%v: %v", ns, secretName, err)
+			return fail("Error updating %v %v/%v: %v", kind.Kind, ns, name, err)
 		}
+		c.recordCopyEvent(srcRef, namespace, apicorev1.EventTypeNormal, reasonSynced, "Updated %v %v/%v from %v/%v", kind.Kind, ns, name, src.GetNamespace(), srcNames)
+		recordConflicts()
+		return c.rollWorkloads(l, kind, namespace, name, d.hash, true)
+	}
+
+	newObj.SetResourceVersion("")
+	err = c.writer.create(kind, newObj)
+	logWrite(l, "create", err)
+	if apierrors.IsAlreadyExists(err) {
+		// Our cache is behind.  We can't tell who owns what is there so back
+		// off and try again once the informer has caught up.
+		return fmt.Errorf("%v %v/%v already exists but isn't in our cache yet", kind.Kind, ns, name)
+	}
+	if err != nil {
+		return fail("Error adding %v %v/%v: %v", kind.Kind, ns, name, err)
+	}
+	c.recordCopyEvent(srcRef, namespace, apicorev1.EventTypeNormal, reasonSynced, "Created %v %v/%v from %v/%v", kind.Kind, ns, name, src.GetNamespace(), srcNames)
+	recordConflicts()
+	return nil
+}
+
+// mayAdopt returns true for legacy copies we should take over as d, see
+// provenance.go.  Without adoptExisting the copy has to be a plain copy of
+// the one source of d, under the same name.
+func (c *TGIKController) mayAdopt(existing syncObject, d *desiredCopy) bool {
+	if !c.config.isLegacyCopy(existing) {
+		return false
+	}
+	if c.config.AdoptExisting {
+		return true
+	}
+	if len(d.srcs) != 1 || d.srcs[0].GetName() != existing.GetName() {
+		return false
+	}
+	existingContent, err := content(existing)
+	if err != nil {
+		return false
+	}
+	srcContent, err := content(d.srcs[0])
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(existingContent, srcContent)
+}
+
+// logWrite logs the outcome of a create, update or delete of a copy.
+func logWrite(l *structuredLogger, action string, err error) {
+	if err != nil {
+		l.error("write failed", "action", action, "result", "error", "err", err)
+		return
+	}
+	l.info("write done", "action", action, "result", "success")
+}
+
+// recordCopyEvent records the same event against the source object and the
+// target namespace so both sides can see what happened.
+func (c *TGIKController) recordCopyEvent(src apicorev1.ObjectReference, ns *apicorev1.Namespace, eventType, reason, messageFmt string, args ...interface{}) {
+	c.recorder.eventf(src, eventType, reason, messageFmt, args...)
+	c.recorder.eventf(namespaceReference(ns), eventType, reason, messageFmt, args...)
+}
+
+func (c *TGIKController) deleteObject(l *structuredLogger, kind *kindAdapter, namespace *apicorev1.Namespace, name string) error {
+	ns := namespace.Name
+	err := c.writer.delete(kind, ns, name)
+	logWrite(l.with("kind", kind.Kind, "copy", name), "delete", err)
+	if apierrors.IsNotFound(err) {
+		// Already gone, which is what we wanted.
+		return nil
+	}
+	if err != nil {
+		c.recorder.eventf(namespaceReference(namespace), apicorev1.EventTypeWarning, reasonSyncFailed, "Error deleting %v %v/%v: %v", kind.Kind, ns, name, err)
+		return fmt.Errorf("error deleting %v %v/%v: %v", kind.Kind, ns, name, err)
 	}
+	c.recorder.eventf(namespaceReference(namespace), apicorev1.EventTypeNormal, reasonPruned, "Deleted %v %v/%v, its source is gone or no longer targets this namespace", kind.Kind, ns, name)
+	return nil
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+// recordingWriter notes writes as "action kind namespace/name".
+type recordingWriter struct {
+	writes []string
+}
+
+func (w *recordingWriter) create(kind *kindAdapter, obj syncObject) error {
+	w.writes = append(w.writes, fmt.Sprintf("create %v %v/%v", kind.Kind, obj.GetNamespace(), obj.GetName()))
+	return nil
+}
+
+func (w *recordingWriter) update(kind *kindAdapter, obj syncObject) error {
+	w.writes = append(w.writes, fmt.Sprintf("update %v %v/%v", kind.Kind, obj.GetNamespace(), obj.GetName()))
+	return nil
+}
+
+func (w *recordingWriter) delete(kind *kindAdapter, ns, name string) error {
+	w.writes = append(w.writes, fmt.Sprintf("delete %v %v/%v", kind.Kind, ns, name))
+	return nil
+}
+
+// newTestController builds a controller whose caches hold objs, the same way
+// the plan subcommand does, with all writes going to the returned writer.
+func newTestController(t *testing.T, objs ...interface{}) (*TGIKController, *recordingWriter) {
+	client := kubernetes.NewForConfigOrDie(&rest.Config{})
+	sharedInformers := informers.NewSharedInformerFactory(client, 0)
+	kinds, err := newKindAdapters(client, sharedInformers, []string{"Secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaceInformer := sharedInformers.Core().V1().Namespaces()
+	configMapInformer := sharedInformers.Core().V1().ConfigMaps()
+	c := NewTGIKController(client, kinds, namespaceInformer, configMapInformer, defaultSyncConfig())
+	for _, obj := range objs {
+		var err error
+		switch obj.(type) {
+		case *apicorev1.Namespace:
+			err = namespaceInformer.Informer().GetIndexer().Add(obj)
+		case *apicorev1.ConfigMap:
+			err = configMapInformer.Informer().GetIndexer().Add(obj)
+		default:
+			err = kinds[0].Indexer.Add(obj)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &recordingWriter{}
+	c.enableDryRun(w)
+	return c, w
+}
+
+func TestSyncNamespacePrunesFormerTargets(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   cfg.SourceNamespace,
+			UID:         "uid-db",
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+		Data: map[string][]byte{"password": []byte("hunter2")},
+	}
+	copyIn := func(ns, policy string) *apicorev1.Secret {
+		s := &apicorev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "db",
+				Namespace:   ns,
+				Annotations: map[string]string{cfg.Annotation: "true"},
+			},
+			Data: src.Data,
+		}
+		cfg.stampProvenance(s, src)
+		if policy != "" {
+			s.Annotations[cfg.policyAnnotation()] = policy
+		}
+		return s
+	}
+	namespace := func(name string, annotated bool) *apicorev1.Namespace {
+		ns := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if annotated {
+			ns.Annotations = map[string]string{cfg.Annotation: "true"}
+		}
+		return ns
+	}
+	keepPolicy := &apicorev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "keep",
+			Namespace: cfg.SourceNamespace,
+			Labels:    map[string]string{cfg.policyLabel(): "true"},
+		},
+		Data: map[string]string{policySpecKey: "secrets: [db]\nnamespaceSelector: team=none\nprune: false\n"},
+	}
+
+	tests := []struct {
+		name string
+		objs []interface{}
+		ns   string
+		want []string
+	}{
+		{
+			name: "annotation removed",
+			objs: []interface{}{namespace("team-a", false), copyIn("team-a", "")},
+			ns:   "team-a",
+			want: []string{"delete Secret team-a/db"},
+		},
+		{
+			name: "policy deleted",
+			objs: []interface{}{namespace("team-a", false), copyIn("team-a", "payments")},
+			ns:   "team-a",
+			want: []string{"delete Secret team-a/db"},
+		},
+		{
+			name: "no longer selected by a policy that keeps copies",
+			objs: []interface{}{namespace("team-a", false), copyIn("team-a", "keep"), keepPolicy},
+			ns:   "team-a",
+			want: nil,
+		},
+		{
+			name: "blacklisted namespace is never touched",
+			objs: []interface{}{namespace("kube-system", false), copyIn("kube-system", "")},
+			ns:   "kube-system",
+			want: nil,
+		},
+		{
+			name: "still a target",
+			objs: []interface{}{namespace("team-a", true), copyIn("team-a", "")},
+			ns:   "team-a",
+			want: []string{"update Secret team-a/db"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := newTestController(t, append([]interface{}{src}, tt.objs...)...)
+			if err := c.syncNamespace(logger, tt.ns); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(w.writes)
+			if !reflect.DeepEqual(w.writes, tt.want) {
+				t.Errorf("writes = %q, want %q", w.writes, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessNextWorkItemAfterStop(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   cfg.SourceNamespace,
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+	}
+	ns := &apicorev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+	}
+	c, w := newTestController(t, src, ns)
+	c.queue.Add(workItem{Namespace: "team-a"})
+	c.queue.Add(workItem{Kind: "Secret", Namespace: "team-a", Name: "db"})
+
+	stop := make(chan struct{})
+	close(stop)
+	c.queue.ShutDown()
+	for c.processNextWorkItem(stop) {
+	}
+	if len(w.writes) != 0 {
+		t.Errorf("synced queued items after stop: %q", w.writes)
+	}
+}
+
+func TestCopyLeavesNoTraceOfExcludedKeys(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db",
+			Namespace: cfg.SourceNamespace,
+			Annotations: map[string]string{
+				cfg.Annotation:               "true",
+				cfg.excludeKeysAnnotation():  "password",
+				lastAppliedConfigAnnotation:  `{"apiVersion":"v1","kind":"Secret","data":{"password":"aHVudGVyMg==","user":"YWRtaW4="}}`,
+				"example.com/rotation-notes": "old password was hunter2",
+				"example.com/owner":          "payments",
+			},
+		},
+		Data: map[string][]byte{"password": []byte("hunter2"), "user": []byte("admin")},
+	}
+	ns := &apicorev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+	}
+	c, _ := newTestController(t, src, ns)
+
+	desired, err := c.desiredObjectsIn(c.kinds[0], ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := desired["db"]
+	if d == nil || d.err != nil {
+		t.Fatalf("desired copy = %+v", d)
+	}
+	got := d.obj.(*apicorev1.Secret)
+	if want := map[string][]byte{"user": []byte("admin")}; !reflect.DeepEqual(got.Data, want) {
+		t.Errorf("copy data = %q, want %q", got.Data, want)
+	}
+	for key := range got.Annotations {
+		if !cfg.isOurAnnotation(key) {
+			t.Errorf("copy has foreign annotation %q", key)
+		}
+	}
+	raw, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"hunter2", "aHVudGVyMg"} {
+		if strings.Contains(string(raw), value) {
+			t.Errorf("copy contains %q: %s", value, raw)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// Reasons for the events we record.  These show up in `kubectl describe` so
+// application teams can see why a secret did or didn't show up.
+const (
+	reasonSynced     = "Synced"
+	reasonSyncFailed = "SyncFailed"
+	reasonPruned     = "Pruned"
+	reasonConflict   = "Conflict"
+)
+
+// eventBufferSize is how many events can be waiting to be written before we
+// start dropping them.  Events are best effort; a slow API server shouldn't
+// hold up syncing.
+const eventBufferSize = 1000
+
+// eventRecorder writes Events in the background.  The vendored client-go
+// doesn't have tools/record so this is a much simpler take on it with no
+// aggregation or rate limiting.
+type eventRecorder struct {
+	client    corev1.EventsGetter
+	component string
+	events    chan *apicorev1.Event
+}
+
+func newEventRecorder(client corev1.EventsGetter, component string) *eventRecorder {
+	return &eventRecorder{
+		client:    client,
+		component: component,
+		events:    make(chan *apicorev1.Event, eventBufferSize),
+	}
+}
+
+// run writes queued events until stop is closed.
+func (r *eventRecorder) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-r.events:
+			_, err := r.client.Events(event.Namespace).Create(event)
+			if err != nil {
+				runtime.HandleError(fmt.Errorf("error recording event %v/%v: %v", event.Namespace, event.Reason, err))
+			}
+		}
+	}
+}
+
+// eventf queues an event about ref.  The event is stored in the namespace of
+// the object, or in the namespace itself for Namespace objects, so it is
+// visible to whoever owns that namespace.  A nil recorder drops everything,
+// which is what we want in dry-run mode.
+func (r *eventRecorder) eventf(ref apicorev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	ns := ref.Namespace
+	if ref.Kind == "Namespace" {
+		ns = ref.Name
+	}
+	now := metav1.Now()
+	event := &apicorev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace: ns,
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Source:         apicorev1.EventSource{Component: r.component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+
+	select {
+	case r.events <- event:
+	default:
+		logger.warn("dropping event, too many pending", "reason", reason, "namespace", ns, "name", ref.Name)
+	}
+}
+
+// objectReference builds a reference to one of the objects we replicate.
+func objectReference(kind *kindAdapter, obj metav1.Object) apicorev1.ObjectReference {
+	return apicorev1.ObjectReference{
+		APIVersion:      kind.APIVersion,
+		Kind:            kind.Kind,
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+}
+
+// namespaceReference builds a reference to a target namespace.  It needs the
+// UID: `kubectl describe namespace` only shows events whose involved object
+// has it.
+func namespaceReference(ns *apicorev1.Namespace) apicorev1.ObjectReference {
+	return apicorev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       ns.Name,
+		UID:        ns.UID,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// hashAnnotation is stamped on every copy we write.  It holds the hash of the
+// content we intended to write so we can tell when a copy is already up to
+// date without bumping its resourceVersion.
+func (cfg *syncConfig) hashAnnotation() string {
+	return cfg.Annotation + "-hash"
+}
+
+// objectHash covers everything we manage on a copy: its content (data, spec,
+// ...), labels and annotations (other than the hash annotation itself).
+func (cfg *syncConfig) objectHash(obj syncObject) (string, error) {
+	return cfg.managedHash(obj, obj)
+}
+
+// managedHash hashes obj the way objectHash hashes desired, looking only at
+// the labels and annotations desired has.  Whatever else ends up on a copy
+// (a mutating webhook, a GitOps tracking label, ...) isn't ours and mustn't
+// make the copy look out of date, or we'd fight over it forever.
+func (cfg *syncConfig) managedHash(obj, desired syncObject) (string, error) {
+	c, err := content(obj)
+	if err != nil {
+		return "", err
+	}
+	// encoding/json sorts map keys so this is stable.
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "content=%q\n", raw)
+	cfg.hashMeta(h, obj, desired)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashMeta covers the labels and annotations of obj that managed has too,
+// other than the hash annotation itself.
+func (cfg *syncConfig) hashMeta(h hash.Hash, obj, managed metav1.Object) {
+	hashStringMap(h, "label", managedKeys(obj.GetLabels(), managed.GetLabels(), ""))
+	hashStringMap(h, "annotation", managedKeys(obj.GetAnnotations(), managed.GetAnnotations(), cfg.hashAnnotation()))
+}
+
+// managedKeys returns the entries of m whose key is in managed, leaving out
+// skip.
+func managedKeys(m, managed map[string]string, skip string) map[string]string {
+	out := map[string]string{}
+	for k, v := range m {
+		if _, ok := managed[k]; ok && k != skip {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func hashStringMap(h hash.Hash, prefix string, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s:%q=%q\n", prefix, k, m[k])
+	}
+}
+
+// upToDate checks both that the copy was stamped with the hash we want and
+// that nobody has edited what we manage of it since.  Labels and annotations
+// we stopped writing don't need looking at here: dropping them changed
+// wantHash.
+func (cfg *syncConfig) upToDate(existing, desired syncObject, wantHash string) bool {
+	if existing.GetAnnotations()[cfg.hashAnnotation()] != wantHash {
+		return false
+	}
+	gotHash, err := cfg.managedHash(existing, desired)
+	return err == nil && gotHash == wantHash
+}
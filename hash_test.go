@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestUpToDate(t *testing.T) {
+	cfg := defaultSyncConfig()
+	desired := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "team-a",
+			Labels:      map[string]string{"app": "db"},
+			Annotations: map[string]string{cfg.managedByAnnotation(): controllerName},
+		},
+		Data: map[string][]byte{"password": []byte("hunter2")},
+	}
+	hash, err := cfg.objectHash(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired.Annotations[cfg.hashAnnotation()] = hash
+
+	tests := []struct {
+		name   string
+		modify func(s *apicorev1.Secret)
+		want   bool
+	}{
+		{"unchanged", func(s *apicorev1.Secret) {}, true},
+		{"foreign label", func(s *apicorev1.Secret) { s.Labels["argocd.argoproj.io/instance"] = "apps" }, true},
+		{"foreign annotation", func(s *apicorev1.Secret) { s.Annotations["webhook.example.com/injected"] = "true" }, true},
+		{"edited data", func(s *apicorev1.Secret) { s.Data["password"] = []byte("changed") }, false},
+		{"edited label", func(s *apicorev1.Secret) { s.Labels["app"] = "cache" }, false},
+		{"removed annotation", func(s *apicorev1.Secret) { delete(s.Annotations, cfg.managedByAnnotation()) }, false},
+		{"stale hash", func(s *apicorev1.Secret) { s.Annotations[cfg.hashAnnotation()] = "old" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := &apicorev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            desired.Name,
+					Namespace:       desired.Namespace,
+					ResourceVersion: "42",
+					Labels:          map[string]string{},
+					Annotations:     map[string]string{},
+				},
+				Data: map[string][]byte{},
+			}
+			for k, v := range desired.Labels {
+				existing.Labels[k] = v
+			}
+			for k, v := range desired.Annotations {
+				existing.Annotations[k] = v
+			}
+			for k, v := range desired.Data {
+				existing.Data[k] = v
+			}
+			tt.modify(existing)
+			if got := cfg.upToDate(existing, desired, hash); got != tt.want {
+				t.Errorf("upToDate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
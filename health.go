@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultStuckWorkerThreshold is how long a worker may spend on a single item
+// before we consider it wedged.  A sync only does a handful of API calls so
+// this is very generous.
+const defaultStuckWorkerThreshold = 5 * time.Minute
+
+// healthChecker backs /healthz and /readyz.  The controller tells it when the
+// caches are synced and when workers start and finish items.
+type healthChecker struct {
+	stuckThreshold time.Duration
+
+	mu    sync.Mutex
+	ready bool
+	// inFlight maps queue keys to when a worker picked them up.  The queue
+	// never hands the same key to two workers at once so the key is enough
+	// to identify the item.
+	inFlight map[interface{}]time.Time
+}
+
+func newHealthChecker(stuckThreshold time.Duration) *healthChecker {
+	return &healthChecker{
+		stuckThreshold: stuckThreshold,
+		inFlight:       map[interface{}]time.Time{},
+	}
+}
+
+func (h *healthChecker) setReady(ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = ready
+}
+
+func (h *healthChecker) startItem(key interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inFlight[key] = time.Now()
+}
+
+func (h *healthChecker) finishItem(key interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.inFlight, key)
+}
+
+// stuckItem returns the key of an item that's been in flight for longer than
+// the threshold, if any.
+func (h *healthChecker) stuckItem() (interface{}, time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, start := range h.inFlight {
+		if d := time.Since(start); d > h.stuckThreshold {
+			return key, d, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (h *healthChecker) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	if key, d, stuck := h.stuckItem(); stuck {
+		http.Error(w, fmt.Sprintf("worker stuck on %v for %v", key, d), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *healthChecker) ServeReadyz(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	ready := h.ready
+	h.mu.Unlock()
+	if !ready {
+		http.Error(w, "caches not synced", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
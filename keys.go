@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// Source secrets can say which of their keys get copied, and under what
+// names, with these annotations:
+//
+//	eightypercent.net/secretsync-include-keys: "ca.crt,*.pem"
+//	eightypercent.net/secretsync-exclude-keys: "tls.key"
+//	eightypercent.net/secretsync-rename-keys: "ca.crt=ca.pem,tls.crt=cert.pem"
+//
+// Any source object can pick the name of its copies with
+//
+//	eightypercent.net/secretsync-target-name: shared-tls
+//
+// Secrets sharing a target name are merged, see merge.go.
+//
+// Policies have the same knobs as fields and ignore these annotations.
+
+func (cfg *syncConfig) includeKeysAnnotation() string {
+	return cfg.Annotation + "-include-keys"
+}
+
+func (cfg *syncConfig) excludeKeysAnnotation() string {
+	return cfg.Annotation + "-exclude-keys"
+}
+
+func (cfg *syncConfig) renameKeysAnnotation() string {
+	return cfg.Annotation + "-rename-keys"
+}
+
+func (cfg *syncConfig) targetNameAnnotation() string {
+	return cfg.Annotation + "-target-name"
+}
+
+// keyFilter picks keys with path.Match patterns.  A key is copied if it
+// matches Include (or Include is empty) and doesn't match Exclude.  Keys that
+// make it through are then renamed according to Rename.
+type keyFilter struct {
+	Include []string          `json:"include,omitempty"`
+	Exclude []string          `json:"exclude,omitempty"`
+	Rename  map[string]string `json:"rename,omitempty"`
+}
+
+func (f keyFilter) validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q: %v", pattern, err)
+		}
+	}
+	for from, to := range f.Rename {
+		if errs := validation.IsConfigMapKey(to); len(errs) != 0 {
+			return fmt.Errorf("invalid new name %q for key %q: %v", to, from, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+func (f keyFilter) allows(key string) bool {
+	if len(f.Include) != 0 && !matchesAny(f.Include, key) {
+		return false
+	}
+	return !matchesAny(f.Exclude, key)
+}
+
+// apply filters and renames the keys of a secret.  Renaming two keys to the
+// same name, or one onto a key that is kept, is an error.
+func (f keyFilter) apply(secret *apicorev1.Secret) error {
+	data := map[string][]byte{}
+	renamedFrom := map[string]string{}
+	for key, value := range secret.Data {
+		if !f.allows(key) {
+			continue
+		}
+		newKey := key
+		if to, ok := f.Rename[key]; ok {
+			newKey = to
+		}
+		if other, ok := renamedFrom[newKey]; ok {
+			return fmt.Errorf("keys %q and %q would both be copied as %q", other, key, newKey)
+		}
+		renamedFrom[newKey] = key
+		data[newKey] = value
+	}
+	secret.Data = data
+	return nil
+}
+
+// keyFilterFromAnnotations reads the key annotations off a source object.
+func (cfg *syncConfig) keyFilterFromAnnotations(obj metav1.Object) (keyFilter, error) {
+	annotations := obj.GetAnnotations()
+	f := keyFilter{
+		Include: splitList(annotations[cfg.includeKeysAnnotation()]),
+		Exclude: splitList(annotations[cfg.excludeKeysAnnotation()]),
+	}
+	for _, pair := range splitList(annotations[cfg.renameKeysAnnotation()]) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return keyFilter{}, fmt.Errorf("invalid rename %q in %v, want old=new", pair, cfg.renameKeysAnnotation())
+		}
+		if f.Rename == nil {
+			f.Rename = map[string]string{}
+		}
+		f.Rename[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if err := f.validate(); err != nil {
+		return keyFilter{}, err
+	}
+	return f, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func validateTargetName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+		return fmt.Errorf("invalid target name %q: %v", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// targetName is the name the copies of src get.
+func (c *TGIKController) targetName(src metav1.Object, policy *syncPolicy) string {
+	if policy != nil {
+		if name, ok := policy.Spec.TargetNames[src.GetName()]; ok {
+			return name
+		}
+		return src.GetName()
+	}
+	if name, ok := src.GetAnnotations()[c.config.targetNameAnnotation()]; ok && name != "" {
+		return name
+	}
+	return src.GetName()
+}
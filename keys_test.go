@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestKeyFilterApply(t *testing.T) {
+	data := map[string]string{
+		"ca.crt":  "ca",
+		"tls.crt": "cert",
+		"tls.key": "key",
+	}
+	tests := []struct {
+		name    string
+		filter  keyFilter
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "empty filter copies everything",
+			filter: keyFilter{},
+			want:   data,
+		},
+		{
+			name:   "include",
+			filter: keyFilter{Include: []string{"*.crt"}},
+			want:   map[string]string{"ca.crt": "ca", "tls.crt": "cert"},
+		},
+		{
+			name:   "exclude",
+			filter: keyFilter{Exclude: []string{"*.key"}},
+			want:   map[string]string{"ca.crt": "ca", "tls.crt": "cert"},
+		},
+		{
+			name:   "exclude wins over include",
+			filter: keyFilter{Include: []string{"tls.*"}, Exclude: []string{"tls.key"}},
+			want:   map[string]string{"tls.crt": "cert"},
+		},
+		{
+			name:   "rename",
+			filter: keyFilter{Rename: map[string]string{"ca.crt": "ca.pem"}},
+			want:   map[string]string{"ca.pem": "ca", "tls.crt": "cert", "tls.key": "key"},
+		},
+		{
+			name:   "rename of a filtered out key is ignored",
+			filter: keyFilter{Exclude: []string{"tls.key"}, Rename: map[string]string{"tls.key": "ca.crt"}},
+			want:   map[string]string{"ca.crt": "ca", "tls.crt": "cert"},
+		},
+		{
+			name:   "swapping names",
+			filter: keyFilter{Rename: map[string]string{"tls.crt": "tls.key", "tls.key": "tls.crt"}},
+			want:   map[string]string{"ca.crt": "ca", "tls.crt": "key", "tls.key": "cert"},
+		},
+		{
+			name:    "two keys renamed to the same name",
+			filter:  keyFilter{Rename: map[string]string{"tls.crt": "bundle", "ca.crt": "bundle"}},
+			wantErr: true,
+		},
+		{
+			name:    "rename onto a kept key",
+			filter:  keyFilter{Rename: map[string]string{"ca.crt": "tls.crt"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &apicorev1.Secret{Data: map[string][]byte{}}
+			for k, v := range data {
+				secret.Data[k] = []byte(v)
+			}
+			err := tt.filter.apply(secret)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("apply() succeeded with %v", secret.Data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() failed: %v", err)
+			}
+			got := map[string]string{}
+			for k, v := range secret.Data {
+				got[k] = string(v)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyFilterFromAnnotations(t *testing.T) {
+	cfg := defaultSyncConfig()
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        keyFilter
+		wantErr     bool
+	}{
+		{
+			name: "none",
+			want: keyFilter{},
+		},
+		{
+			name: "lists and renames",
+			annotations: map[string]string{
+				cfg.includeKeysAnnotation(): "ca.crt, *.pem,",
+				cfg.excludeKeysAnnotation(): "tls.key",
+				cfg.renameKeysAnnotation():  "ca.crt=ca.pem, tls.crt = cert.pem",
+			},
+			want: keyFilter{
+				Include: []string{"ca.crt", "*.pem"},
+				Exclude: []string{"tls.key"},
+				Rename:  map[string]string{"ca.crt": "ca.pem", "tls.crt": "cert.pem"},
+			},
+		},
+		{
+			name:        "rename without new name",
+			annotations: map[string]string{cfg.renameKeysAnnotation(): "ca.crt="},
+			wantErr:     true,
+		},
+		{
+			name:        "rename to an invalid key",
+			annotations: map[string]string{cfg.renameKeysAnnotation(): "ca.crt=ca/pem"},
+			wantErr:     true,
+		},
+		{
+			name:        "bad pattern",
+			annotations: map[string]string{cfg.includeKeysAnnotation(): "[ca"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &apicorev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			got, err := cfg.keyFilterFromAnnotations(obj)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("keyFilterFromAnnotations() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("keyFilterFromAnnotations() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keyFilterFromAnnotations() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
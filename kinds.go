@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// lastAppliedConfigAnnotation is where `kubectl apply` keeps the whole
+// object it last applied.
+const lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// syncObject is any API object we can replicate.  All of the typed API
+// objects (*Secret, *ConfigMap, ...) satisfy it.
+type syncObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// kindAdapter is everything the controller needs to know to replicate one
+// kind of namespaced object.  The create/update/prune pipeline in the
+// controller only ever talks to objects through one of these.
+type kindAdapter struct {
+	// Kind and APIVersion are used for work items, events and metrics.
+	Kind       string
+	APIVersion string
+	// Resource is the plural resource name used with Client.
+	Resource string
+	// Client is the REST client for the API group the kind lives in.
+	Client rest.Interface
+
+	// Informer feeds events for this kind.  Indexer is its cache and is what
+	// we list and get from.
+	Informer cache.SharedIndexInformer
+	Indexer  cache.Indexer
+
+	// Strip clears anything on a fresh copy that must not be replicated.  It
+	// may be nil.
+	Strip func(obj syncObject)
+}
+
+// list returns every object of this kind in ns from the cache.
+func (k *kindAdapter) list(ns string) ([]syncObject, error) {
+	items, err := k.Indexer.ByIndex(cache.NamespaceIndex, ns)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]syncObject, 0, len(items))
+	for _, item := range items {
+		obj, ok := item.(syncObject)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T in %v cache", item, k.Kind)
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// get returns nil if the object isn't in the cache.
+func (k *kindAdapter) get(ns, name string) (syncObject, error) {
+	item, exists, err := k.Indexer.GetByKey(ns + "/" + name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	obj, ok := item.(syncObject)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %T in %v cache", item, k.Kind)
+	}
+	return obj, nil
+}
+
+// copy makes a fresh object for ns from src with all of the server managed
+// metadata cleared.
+func (k *kindAdapter) copy(src syncObject, ns string) (syncObject, error) {
+	objInf, err := scheme.Scheme.DeepCopy(src)
+	if err != nil {
+		return nil, err
+	}
+	obj := objInf.(syncObject)
+	obj.SetNamespace(ns)
+	obj.SetResourceVersion("")
+	obj.SetUID("")
+	obj.SetSelfLink("")
+	obj.SetCreationTimestamp(metav1.Time{})
+	obj.SetGeneration(0)
+	obj.SetDeletionTimestamp(nil)
+	obj.SetDeletionGracePeriodSeconds(nil)
+	// Owner references can't point across namespaces and nothing in the
+	// target namespace would ever clear the source's finalizers.
+	obj.SetOwnerReferences(nil)
+	obj.SetFinalizers(nil)
+	if obj.GetAnnotations() == nil {
+		obj.SetAnnotations(map[string]string{})
+	}
+	// This describes the source as it was applied, not the copy, and would
+	// carry anything we filter out of the copy along with it.
+	delete(obj.GetAnnotations(), lastAppliedConfigAnnotation)
+	if k.Strip != nil {
+		k.Strip(obj)
+	}
+	return obj, nil
+}
+
+func (k *kindAdapter) create(obj syncObject) error {
+	return k.Client.Post().
+		Namespace(obj.GetNamespace()).
+		Resource(k.Resource).
+		Body(obj).
+		Do().
+		Error()
+}
+
+func (k *kindAdapter) update(obj syncObject) error {
+	return k.Client.Put().
+		Namespace(obj.GetNamespace()).
+		Resource(k.Resource).
+		Name(obj.GetName()).
+		Body(obj).
+		Do().
+		Error()
+}
+
+func (k *kindAdapter) delete(ns, name string) error {
+	return k.Client.Delete().
+		Namespace(ns).
+		Resource(k.Resource).
+		Name(name).
+		Do().
+		Error()
+}
+
+// content is the replicated payload of an object: everything but the type
+// and object metadata and the status.  Comparing content is how we tell if a
+// copy differs from its source for any kind without knowing its fields.
+func content(obj runtime.Object) (map[string]interface{}, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "apiVersion")
+	delete(m, "kind")
+	delete(m, "metadata")
+	delete(m, "status")
+	return m, nil
+}
+
+// kindConstructors knows how to build the adapter for each kind we support.
+var kindConstructors = map[string]func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter{
+	"Secret": func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter {
+		informer := f.Core().V1().Secrets().Informer()
+		return &kindAdapter{
+			Kind:       "Secret",
+			APIVersion: "v1",
+			Resource:   "secrets",
+			Client:     client.CoreV1().RESTClient(),
+			Informer:   informer,
+			Indexer:    informer.GetIndexer(),
+		}
+	},
+	"ConfigMap": func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter {
+		informer := f.Core().V1().ConfigMaps().Informer()
+		return &kindAdapter{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+			Resource:   "configmaps",
+			Client:     client.CoreV1().RESTClient(),
+			Informer:   informer,
+			Indexer:    informer.GetIndexer(),
+		}
+	},
+	"RoleBinding": func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter {
+		informer := f.Rbac().V1beta1().RoleBindings().Informer()
+		return &kindAdapter{
+			Kind:       "RoleBinding",
+			APIVersion: "rbac.authorization.k8s.io/v1beta1",
+			Resource:   "rolebindings",
+			Client:     client.RbacV1beta1().RESTClient(),
+			Informer:   informer,
+			Indexer:    informer.GetIndexer(),
+		}
+	},
+	"NetworkPolicy": func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter {
+		informer := f.Networking().V1().NetworkPolicies().Informer()
+		return &kindAdapter{
+			Kind:       "NetworkPolicy",
+			APIVersion: "networking.k8s.io/v1",
+			Resource:   "networkpolicies",
+			Client:     client.NetworkingV1().RESTClient(),
+			Informer:   informer,
+			Indexer:    informer.GetIndexer(),
+		}
+	},
+	"LimitRange": func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter {
+		informer := f.Core().V1().LimitRanges().Informer()
+		return &kindAdapter{
+			Kind:       "LimitRange",
+			APIVersion: "v1",
+			Resource:   "limitranges",
+			Client:     client.CoreV1().RESTClient(),
+			Informer:   informer,
+			Indexer:    informer.GetIndexer(),
+		}
+	},
+	"ResourceQuota": func(client kubernetes.Interface, f informers.SharedInformerFactory) *kindAdapter {
+		informer := f.Core().V1().ResourceQuotas().Informer()
+		return &kindAdapter{
+			Kind:       "ResourceQuota",
+			APIVersion: "v1",
+			Resource:   "resourcequotas",
+			Client:     client.CoreV1().RESTClient(),
+			Informer:   informer,
+			Indexer:    informer.GetIndexer(),
+			Strip: func(obj syncObject) {
+				// Usage is tracked per namespace by the quota controller.
+				obj.(*apicorev1.ResourceQuota).Status = apicorev1.ResourceQuotaStatus{}
+			},
+		}
+	},
+}
+
+var defaultKinds = []string{"Secret", "ConfigMap"}
+
+func supportedKinds() []string {
+	var kinds []string
+	for kind := range kindConstructors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// newKindAdapters builds the adapters for the named kinds.  Only the
+// informers for these kinds get created so we don't need RBAC to watch kinds
+// we don't replicate.
+func newKindAdapters(client kubernetes.Interface, f informers.SharedInformerFactory, kinds []string) ([]*kindAdapter, error) {
+	var adapters []*kindAdapter
+	for _, kind := range kinds {
+		newAdapter, ok := kindConstructors[kind]
+		if !ok {
+			return nil, fmt.Errorf("unsupported kind %q, must be one of %v", kind, strings.Join(supportedKinds(), ", "))
+		}
+		adapters = append(adapters, newAdapter(client, f))
+	}
+	return adapters, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestCopyClearsServerMetadata(t *testing.T) {
+	grace := int64(30)
+	now := metav1.Now()
+	src := &apicorev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:                       "settings",
+			Namespace:                  "secretsync",
+			ResourceVersion:            "42",
+			UID:                        "1234",
+			SelfLink:                   "/api/v1/namespaces/secretsync/configmaps/settings",
+			CreationTimestamp:          now,
+			Generation:                 3,
+			DeletionTimestamp:          &now,
+			DeletionGracePeriodSeconds: &grace,
+			OwnerReferences:            []metav1.OwnerReference{{Kind: "Deployment", Name: "api"}},
+			Finalizers:                 []string{"example.com/cleanup"},
+			Labels:                     map[string]string{"app": "api"},
+			Annotations:                map[string]string{lastAppliedConfigAnnotation: `{"data":{"key":"value"}}`},
+		},
+		Data: map[string]string{"key": "value"},
+	}
+
+	obj, err := (&kindAdapter{Kind: "ConfigMap"}).copy(src, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := obj.(*apicorev1.ConfigMap)
+	want := metav1.ObjectMeta{
+		Name:        "settings",
+		Namespace:   "team-a",
+		Labels:      map[string]string{"app": "api"},
+		Annotations: map[string]string{},
+	}
+	if !reflect.DeepEqual(got.ObjectMeta, want) {
+		t.Errorf("copy metadata = %+v, want %+v", got.ObjectMeta, want)
+	}
+	if !reflect.DeepEqual(got.Data, src.Data) {
+		t.Errorf("copy data = %v, want %v", got.Data, src.Data)
+	}
+	if len(src.Finalizers) != 1 || src.DeletionTimestamp == nil {
+		t.Errorf("copy changed the source: %+v", src.ObjectMeta)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// The client-go we vendor doesn't ship the leaderelection package yet, so this
+// is a small version of the same idea.  The lease lives in an annotation on a
+// ConfigMap, using the same record format and annotation key as the upstream
+// ConfigMap lock.  Whoever last renewed the record within the lease duration
+// is the leader.  Everybody else keeps retrying until the lease runs out.
+
+const leaderElectionRecordAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+// leaderElectionJitter spreads out the retries of the candidates so they don't
+// all hit the API server at once.
+const leaderElectionJitter = 1.2
+
+type leaderElectionRecord struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+type leaderElectionConfig struct {
+	// Namespace and Name of the ConfigMap holding the lease.
+	Namespace string
+	Name      string
+	// Identity is what we write into the lease.  It must be unique across
+	// replicas; the pod name is a good choice.
+	Identity string
+
+	// LeaseDuration is how long non-leaders wait before they try to take over
+	// a lease that hasn't been renewed.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps retrying to renew before it
+	// gives up leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is how long to wait between attempts.
+	RetryPeriod time.Duration
+}
+
+type leaderElector struct {
+	config leaderElectionConfig
+	client corev1.ConfigMapsGetter
+
+	// observedRecord is the last record we saw and observedTime is when we
+	// saw it change.  We use our own clock for expiry, not the times in the
+	// record, so clock skew between replicas doesn't matter.
+	observedRecord leaderElectionRecord
+	observedRaw    string
+	observedTime   time.Time
+}
+
+func newLeaderElector(client corev1.ConfigMapsGetter, config leaderElectionConfig) (*leaderElector, error) {
+	if config.Identity == "" {
+		return nil, fmt.Errorf("leader election identity must not be empty")
+	}
+	if config.LeaseDuration <= config.RenewDeadline {
+		return nil, fmt.Errorf("lease duration (%v) must be greater than renew deadline (%v)", config.LeaseDuration, config.RenewDeadline)
+	}
+	if config.RenewDeadline <= time.Duration(leaderElectionJitter*float64(config.RetryPeriod)) {
+		return nil, fmt.Errorf("renew deadline (%v) must be greater than retry period (%v) * %v", config.RenewDeadline, config.RetryPeriod, leaderElectionJitter)
+	}
+	return &leaderElector{
+		config: config,
+		client: client,
+	}, nil
+}
+
+// Run blocks until we become the leader, then calls run and keeps renewing
+// the lease.  The stop channel handed to run is closed when we lose the lease
+// or when stop is closed.
+//
+// When stop is closed we wait for run to return and then give up the lease
+// so another replica can take over right away instead of waiting for it to
+// expire.  We don't renew while waiting, so run has to be done well within
+// the lease duration, see validateShutdownGracePeriod.
+//
+// When we lose the lease Run returns true right away without waiting for
+// run.  Another replica may take over as soon as the lease runs out, so the
+// caller must exit before whatever run is doing can race with it.
+func (le *leaderElector) Run(stop <-chan struct{}, run func(stop <-chan struct{})) (lost bool) {
+	if !le.acquire(stop) {
+		return false
+	}
+
+	leaderStop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(leaderStop)
+	}()
+
+	lost = le.renew(stop)
+	close(leaderStop)
+	if lost {
+		return true
+	}
+	<-done
+	le.release()
+	return false
+}
+
+// validateShutdownGracePeriod makes sure workers finishing up after a stop
+// signal are done before the lease we stopped renewing can be taken over.
+func validateShutdownGracePeriod(grace time.Duration, config leaderElectionConfig) error {
+	if limit := config.LeaseDuration - config.RenewDeadline; grace >= limit {
+		return fmt.Errorf("shutdown grace period (%v) must be shorter than lease duration minus renew deadline (%v)", grace, limit)
+	}
+	return nil
+}
+
+func (le *leaderElector) acquire(stop <-chan struct{}) bool {
+	logger.info("attempting to acquire leader lease", "namespace", le.config.Namespace, "name", le.config.Name, "identity", le.config.Identity)
+	for {
+		if le.tryAcquireOrRenew() {
+			logger.info("acquired leader lease", "namespace", le.config.Namespace, "name", le.config.Name)
+			return true
+		}
+		select {
+		case <-stop:
+			return false
+		case <-time.After(wait.Jitter(le.config.RetryPeriod, leaderElectionJitter)):
+		}
+	}
+}
+
+// renew returns true when we've failed to renew for longer than
+// RenewDeadline and false when stop is closed.
+func (le *leaderElector) renew(stop <-chan struct{}) bool {
+	for {
+		deadline := time.Now().Add(le.config.RenewDeadline)
+		for !le.tryAcquireOrRenew() {
+			if time.Now().After(deadline) {
+				logger.warn("failed to renew leader lease", "namespace", le.config.Namespace, "name", le.config.Name)
+				return true
+			}
+			select {
+			case <-stop:
+				return false
+			case <-time.After(le.config.RetryPeriod):
+			}
+		}
+		select {
+		case <-stop:
+			return false
+		case <-time.After(le.config.RetryPeriod):
+		}
+	}
+}
+
+func (le *leaderElector) tryAcquireOrRenew() bool {
+	now := metav1.Now()
+	record := leaderElectionRecord{
+		HolderIdentity:       le.config.Identity,
+		LeaseDurationSeconds: int(le.config.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	cm, err := le.client.ConfigMaps(le.config.Namespace).Get(le.config.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &apicorev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   le.config.Namespace,
+				Name:        le.config.Name,
+				Annotations: map[string]string{},
+			},
+		}
+		if err := le.writeRecord(cm, record); err != nil {
+			return false
+		}
+		_, err = le.client.ConfigMaps(le.config.Namespace).Create(cm)
+		if err != nil {
+			runtime.HandleError(fmt.Errorf("error creating leader lease: %v", err))
+			return false
+		}
+		le.observe(record, cm.Annotations[leaderElectionRecordAnnotation])
+		return true
+	}
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error getting leader lease: %v", err))
+		return false
+	}
+
+	var existing leaderElectionRecord
+	raw := cm.Annotations[leaderElectionRecordAnnotation]
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &existing); err != nil {
+			runtime.HandleError(fmt.Errorf("error decoding leader lease: %v", err))
+			return false
+		}
+	}
+	if raw != le.observedRaw {
+		le.observe(existing, raw)
+	}
+
+	if existing.HolderIdentity != "" &&
+		existing.HolderIdentity != le.config.Identity &&
+		le.observedTime.Add(time.Duration(existing.LeaseDurationSeconds)*time.Second).After(now.Time) {
+		return false
+	}
+
+	if existing.HolderIdentity == le.config.Identity {
+		record.AcquireTime = existing.AcquireTime
+		record.LeaderTransitions = existing.LeaderTransitions
+	} else {
+		record.LeaderTransitions = existing.LeaderTransitions + 1
+	}
+
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	if err := le.writeRecord(cm, record); err != nil {
+		return false
+	}
+	_, err = le.client.ConfigMaps(le.config.Namespace).Update(cm)
+	if err != nil {
+		// Most likely a conflict because somebody else got there first.
+		runtime.HandleError(fmt.Errorf("error updating leader lease: %v", err))
+		return false
+	}
+	le.observe(record, cm.Annotations[leaderElectionRecordAnnotation])
+	return true
+}
+
+// release steps down by writing a record with no holder.  Other candidates
+// will pick the lease up on their next retry.
+func (le *leaderElector) release() {
+	if le.observedRecord.HolderIdentity != le.config.Identity {
+		return
+	}
+	cm, err := le.client.ConfigMaps(le.config.Namespace).Get(le.config.Name, metav1.GetOptions{})
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error getting leader lease for release: %v", err))
+		return
+	}
+	if cm.Annotations[leaderElectionRecordAnnotation] != le.observedRaw {
+		// Somebody else has taken over already.
+		return
+	}
+
+	now := metav1.Now()
+	record := leaderElectionRecord{
+		LeaseDurationSeconds: 1,
+		AcquireTime:          now,
+		RenewTime:            now,
+		LeaderTransitions:    le.observedRecord.LeaderTransitions,
+	}
+	if err := le.writeRecord(cm, record); err != nil {
+		return
+	}
+	if _, err := le.client.ConfigMaps(le.config.Namespace).Update(cm); err != nil {
+		runtime.HandleError(fmt.Errorf("error releasing leader lease: %v", err))
+		return
+	}
+	le.observe(record, cm.Annotations[leaderElectionRecordAnnotation])
+	logger.info("released leader lease", "namespace", le.config.Namespace, "name", le.config.Name)
+}
+
+func (le *leaderElector) writeRecord(cm *apicorev1.ConfigMap, record leaderElectionRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error encoding leader lease: %v", err))
+		return err
+	}
+	cm.Annotations[leaderElectionRecordAnnotation] = string(raw)
+	return nil
+}
+
+func (le *leaderElector) observe(record leaderElectionRecord, raw string) {
+	le.observedRecord = record
+	le.observedRaw = raw
+	le.observedTime = time.Now()
+}
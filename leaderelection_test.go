@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeConfigMaps holds a single ConfigMap.  Once broken is set every call
+// fails, as if the API server had gone away.
+type fakeConfigMaps struct {
+	corev1.ConfigMapInterface
+
+	mu     sync.Mutex
+	cm     *apicorev1.ConfigMap
+	broken bool
+}
+
+func (f *fakeConfigMaps) ConfigMaps(namespace string) corev1.ConfigMapInterface {
+	return f
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*apicorev1.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return nil, fmt.Errorf("connection refused")
+	}
+	if f.cm == nil {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	cm := *f.cm
+	cm.Annotations = map[string]string{}
+	for k, v := range f.cm.Annotations {
+		cm.Annotations[k] = v
+	}
+	return &cm, nil
+}
+
+func (f *fakeConfigMaps) Create(cm *apicorev1.ConfigMap) (*apicorev1.ConfigMap, error) {
+	return f.Update(cm)
+}
+
+func (f *fakeConfigMaps) Update(cm *apicorev1.ConfigMap) (*apicorev1.ConfigMap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return nil, fmt.Errorf("connection refused")
+	}
+	f.cm = cm
+	return cm, nil
+}
+
+func (f *fakeConfigMaps) setBroken() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broken = true
+}
+
+func TestLeaderElectorReturnsRightAwayWhenLeaseIsLost(t *testing.T) {
+	client := &fakeConfigMaps{}
+	le, err := newLeaderElector(client, leaderElectionConfig{
+		Namespace:     "secretsync",
+		Name:          "tgik-controller",
+		Identity:      "a",
+		LeaseDuration: 500 * time.Millisecond,
+		RenewDeadline: 100 * time.Millisecond,
+		RetryPeriod:   20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	result := make(chan bool)
+	go func() {
+		result <- le.Run(stop, func(leaderStop <-chan struct{}) {
+			client.setBroken()
+			// Workers that take forever to drain must not hold us up.
+			<-stuck
+		})
+	}()
+
+	select {
+	case lost := <-result:
+		if !lost {
+			t.Errorf("Run() = false, want true after losing the lease")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() waited for run after losing the lease")
+	}
+}
+
+func TestLeaderElectorReleasesOnStop(t *testing.T) {
+	client := &fakeConfigMaps{}
+	le, err := newLeaderElector(client, leaderElectionConfig{
+		Namespace:     "secretsync",
+		Name:          "tgik-controller",
+		Identity:      "a",
+		LeaseDuration: 500 * time.Millisecond,
+		RenewDeadline: 100 * time.Millisecond,
+		RetryPeriod:   20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	ran := false
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(stop)
+	}()
+	lost := le.Run(stop, func(leaderStop <-chan struct{}) {
+		<-leaderStop
+		ran = true
+	})
+	if lost {
+		t.Errorf("Run() = true, want false after stop")
+	}
+	if !ran {
+		t.Errorf("Run() returned before run did")
+	}
+	if le.observedRecord.HolderIdentity != "" {
+		t.Errorf("lease still held by %q", le.observedRecord.HolderIdentity)
+	}
+}
+
+func TestValidateShutdownGracePeriod(t *testing.T) {
+	config := leaderElectionConfig{
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+	tests := []struct {
+		grace   time.Duration
+		wantErr bool
+	}{
+		{3 * time.Second, false},
+		{5 * time.Second, true},
+		{30 * time.Second, true},
+	}
+	for _, tt := range tests {
+		err := validateShutdownGracePeriod(tt.grace, config)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateShutdownGracePeriod(%v) = %v, want error %v", tt.grace, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// We don't vendor a logging library so this is a small leveled logger that
+// writes one line per message as logfmt or JSON.  Messages take key/value
+// pairs after the message, as in
+//
+//	l.info("created copy", "kind", "Secret", "namespace", ns, "name", name)
+//
+// Nothing that could hold secret data gets printed as is, see logValue.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of debug, info, warn, error", name)
+}
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+// logSink is the shared part of all loggers derived from one another.
+type logSink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  logLevel
+}
+
+type structuredLogger struct {
+	sink *logSink
+	// fields are key/value pairs added to every message.
+	fields []interface{}
+}
+
+func newStructuredLogger(out io.Writer, format string, level logLevel) (*structuredLogger, error) {
+	if format != logFormatLogfmt && format != logFormatJSON {
+		return nil, fmt.Errorf("unknown log format %q, must be %v or %v", format, logFormatLogfmt, logFormatJSON)
+	}
+	return &structuredLogger{
+		sink: &logSink{out: out, format: format, level: level},
+	}, nil
+}
+
+// logger is what everything logs through.  main replaces it once the flags
+// are parsed.
+var logger, _ = newStructuredLogger(os.Stderr, logFormatLogfmt, levelInfo)
+
+func init() {
+	// Send errors from client-go and our own runtime.HandleError calls
+	// through the same logger.  The first handler is the one logging to
+	// glog; the rest back off on error storms and stay.
+	runtime.ErrorHandlers = append([]func(error){
+		func(err error) {
+			logger.error("unhandled error", "err", err)
+		},
+	}, runtime.ErrorHandlers[1:]...)
+}
+
+// logFlags are the flags picking the log format and level.
+type logFlags struct {
+	format string
+	level  string
+}
+
+func addLogFlags(fs *flag.FlagSet, f *logFlags) {
+	f.format = logFormatLogfmt
+	f.level = logLevelNames[levelInfo]
+	fs.StringVar(&f.format, "log-format", f.format, "log format, logfmt or json")
+	fs.StringVar(&f.level, "log-level", f.level, "lowest level to log, one of debug, info, warn, error")
+}
+
+// setupLogger replaces the global logger according to the flags.
+func setupLogger(f logFlags) error {
+	level, err := parseLogLevel(f.level)
+	if err != nil {
+		return err
+	}
+	l, err := newStructuredLogger(os.Stderr, f.format, level)
+	if err != nil {
+		return err
+	}
+	logger = l
+	return nil
+}
+
+// with returns a logger that adds kv to every message.  Keys l already has
+// get the new value.
+func (l *structuredLogger) with(kv ...interface{}) *structuredLogger {
+	return &structuredLogger{sink: l.sink, fields: mergeFields(l.fields, kv)}
+}
+
+// mergeFields appends the key/value pairs of kv to fields, replacing the
+// value of keys fields already has so no key shows up twice in a line.
+func mergeFields(fields, kv []interface{}) []interface{} {
+	merged := make([]interface{}, 0, len(fields)+len(kv))
+	merged = append(merged, fields...)
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "<missing>"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		replaced := false
+		for j := 0; j < len(merged); j += 2 {
+			if merged[j] == kv[i] {
+				merged[j+1] = value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, kv[i], value)
+		}
+	}
+	return merged
+}
+
+func (l *structuredLogger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *structuredLogger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *structuredLogger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *structuredLogger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// fatal logs at error level and exits.
+func (l *structuredLogger) fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(exitError)
+}
+
+func (l *structuredLogger) log(level logLevel, msg string, kv []interface{}) {
+	if level < l.sink.level {
+		return
+	}
+	keys := []string{"time", "level", "msg"}
+	values := []string{time.Now().UTC().Format(time.RFC3339Nano), logLevelNames[level], msg}
+	all := mergeFields(l.fields, kv)
+	for i := 0; i < len(all); i += 2 {
+		keys = append(keys, fmt.Sprint(all[i]))
+		values = append(values, logValue(all[i+1]))
+	}
+
+	var line bytes.Buffer
+	if l.sink.format == logFormatJSON {
+		line.WriteByte('{')
+		for i := range keys {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			k, _ := json.Marshal(keys[i])
+			v, _ := json.Marshal(values[i])
+			line.Write(k)
+			line.WriteByte(':')
+			line.Write(v)
+		}
+		line.WriteByte('}')
+	} else {
+		for i := range keys {
+			if i > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(keys[i])
+			line.WriteByte('=')
+			line.WriteString(logfmtValue(values[i]))
+		}
+	}
+	line.WriteByte('\n')
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.out.Write(line.Bytes())
+}
+
+// logValue turns a field value into a string.  Secrets and raw data are
+// never printed; API objects are printed as namespace/name.
+func logValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case []byte, map[string][]byte, map[string]string:
+		return "<redacted>"
+	case metav1.Object:
+		if v.GetNamespace() == "" {
+			return v.GetName()
+		}
+		return v.GetNamespace() + "/" + v.GetName()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func logfmtValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	if strings.ContainsAny(s, " \"=\\\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// newCorrelationID returns a short random ID that ties together the log
+// lines of one sync.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoggerReplacesKeys(t *testing.T) {
+	var out bytes.Buffer
+	l, err := newStructuredLogger(&out, logFormatLogfmt, levelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = l.with("sync", "abc", "namespace", "team-a", "kind", "Secret", "name", "db")
+	l = l.with("kind", "ConfigMap", "copy", "shared-db")
+	l.info("write done", "action", "update", "sync", "def")
+
+	line := strings.TrimSpace(out.String())
+	want := `msg="write done" sync=def namespace=team-a kind=ConfigMap name=db copy=shared-db action=update`
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %q, want it to end with %q", line, want)
+	}
+}
+
+func TestLoggerJSONHasNoDuplicateKeys(t *testing.T) {
+	var out bytes.Buffer
+	l, err := newStructuredLogger(&out, logFormatJSON, levelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.with("namespace", "team-a", "name", "db").with("name", "shared-db").info("hello", "namespace", "team-b", "odd")
+
+	decoder := json.NewDecoder(&out)
+	if _, err := decoder.Token(); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]string{}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := decoder.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := seen[key.(string)]; ok {
+			t.Errorf("key %q appears twice", key)
+		}
+		seen[key.(string)] = value.(string)
+	}
+	want := map[string]string{"namespace": "team-b", "name": "shared-db", "odd": "<missing>"}
+	for k, v := range want {
+		if seen[k] != v {
+			t.Errorf("%v = %q, want %q", k, seen[k], v)
+		}
+	}
+}
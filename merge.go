@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// Secrets that end up with the same target name, either through the
+// target name annotation or through the targetNames of a policy, are merged
+// into one composite secret.  The contributors are ordered (by name for
+// annotated secrets, in the order the policy lists them otherwise) and when
+// two of them have the same key the first one wins.  The losing key is
+// reported with a Conflict event.
+//
+// A composite copy records all of its contributors in the source namespace,
+// name and UID annotations as comma separated lists.  It is rewritten
+// without a contributor once that goes away, and pruned once they all have.
+
+// copyGroup is a set of source objects that make up one copy.
+type copyGroup struct {
+	name   string
+	srcs   []syncObject
+	policy *syncPolicy
+}
+
+// groupSources groups srcs by target name, keeping the order of srcs both
+// between and within groups.
+func (c *TGIKController) groupSources(srcs []syncObject, policy *syncPolicy) []*copyGroup {
+	var groups []*copyGroup
+	byName := map[string]*copyGroup{}
+	for _, src := range srcs {
+		name := c.targetName(src, policy)
+		g, ok := byName[name]
+		if !ok {
+			g = &copyGroup{name: name, policy: policy}
+			byName[name] = g
+			groups = append(groups, g)
+		}
+		g.srcs = append(g.srcs, src)
+	}
+	return groups
+}
+
+// mergeSecretData adds the keys of from to into, skipping keys into already
+// has.  owners tracks which source every key of into came from and is
+// updated as keys get added.  It returns a description of every key that
+// was skipped.
+func mergeSecretData(into, from *apicorev1.Secret, fromName string, owners map[string]string) []string {
+	if into.Data == nil {
+		into.Data = map[string][]byte{}
+	}
+	keys := make([]string, 0, len(from.Data))
+	for key := range from.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var conflicts []string
+	for _, key := range keys {
+		if owner, ok := owners[key]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("key %q of %v is ignored, %v already provides it", key, fromName, owner))
+			continue
+		}
+		into.Data[key] = from.Data[key]
+		owners[key] = fromName
+	}
+	return conflicts
+}
+
+// stampContributors records every source of a composite copy.  It is a
+// no-op for plain copies, which stampProvenance already took care of.
+func (cfg *syncConfig) stampContributors(copy metav1.Object, srcs []syncObject) {
+	if len(srcs) < 2 {
+		return
+	}
+	var namespaces, names, uids []string
+	for _, src := range srcs {
+		namespaces = append(namespaces, src.GetNamespace())
+		names = append(names, src.GetName())
+		uids = append(uids, string(src.GetUID()))
+	}
+	annotations := copy.GetAnnotations()
+	annotations[cfg.sourceNamespaceAnnotation()] = strings.Join(namespaces, ",")
+	annotations[cfg.sourceNameAnnotation()] = strings.Join(names, ",")
+	annotations[cfg.sourceUIDAnnotation()] = strings.Join(uids, ",")
+}
+
+// copySourceNames returns the names of the sources a copy was made from.
+func (cfg *syncConfig) copySourceNames(obj metav1.Object) []string {
+	return splitList(obj.GetAnnotations()[cfg.sourceNameAnnotation()])
+}
+
+func (d *desiredCopy) hasSource(name string) bool {
+	for _, src := range d.srcs {
+		if src.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *desiredCopy) sourceNames() []string {
+	var names []string
+	for _, src := range d.srcs {
+		names = append(names, src.GetName())
+	}
+	return names
+}
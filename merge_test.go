@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestMergeSecretData(t *testing.T) {
+	secret := func(data map[string]string) *apicorev1.Secret {
+		s := &apicorev1.Secret{}
+		if data != nil {
+			s.Data = map[string][]byte{}
+			for k, v := range data {
+				s.Data[k] = []byte(v)
+			}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name          string
+		into          map[string]string
+		from          []map[string]string
+		want          map[string]string
+		wantConflicts []string
+	}{
+		{
+			name: "disjoint keys",
+			into: map[string]string{"a": "1"},
+			from: []map[string]string{{"b": "2"}, {"c": "3"}},
+			want: map[string]string{"a": "1", "b": "2", "c": "3"},
+		},
+		{
+			name: "first one wins",
+			into: map[string]string{"a": "1"},
+			from: []map[string]string{{"a": "2", "b": "2"}, {"b": "3", "c": "3"}},
+			want: map[string]string{"a": "1", "b": "2", "c": "3"},
+			wantConflicts: []string{
+				`key "a" of src1 is ignored, src0 already provides it`,
+				`key "b" of src2 is ignored, src1 already provides it`,
+			},
+		},
+		{
+			name: "conflicts are reported in key order",
+			into: map[string]string{"z": "1", "m": "1", "a": "1"},
+			from: []map[string]string{{"z": "2", "a": "2", "m": "2"}},
+			want: map[string]string{"z": "1", "m": "1", "a": "1"},
+			wantConflicts: []string{
+				`key "a" of src1 is ignored, src0 already provides it`,
+				`key "m" of src1 is ignored, src0 already provides it`,
+				`key "z" of src1 is ignored, src0 already provides it`,
+			},
+		},
+		{
+			name: "into without data",
+			into: nil,
+			from: []map[string]string{{"a": "2"}},
+			want: map[string]string{"a": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			into := secret(tt.into)
+			owners := map[string]string{}
+			for key := range tt.into {
+				owners[key] = "src0"
+			}
+			var conflicts []string
+			for i, from := range tt.from {
+				name := fmt.Sprintf("src%d", i+1)
+				conflicts = append(conflicts, mergeSecretData(into, secret(from), name, owners)...)
+			}
+			got := map[string]string{}
+			for k, v := range into.Data {
+				got[k] = string(v)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("data = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("conflicts = %q, want %q", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestGroupSources(t *testing.T) {
+	c := &TGIKController{config: defaultSyncConfig()}
+	src := func(name, targetName string) syncObject {
+		s := &apicorev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}}}
+		if targetName != "" {
+			s.Annotations[c.config.targetNameAnnotation()] = targetName
+		}
+		return s
+	}
+	policy := &syncPolicy{
+		Name: "payments",
+		Spec: syncPolicySpec{TargetNames: map[string]string{"db": "shared", "tls": "shared"}},
+	}
+
+	tests := []struct {
+		name   string
+		srcs   []syncObject
+		policy *syncPolicy
+		want   map[string][]string
+		order  []string
+	}{
+		{
+			name:  "no target names",
+			srcs:  []syncObject{src("a", ""), src("b", "")},
+			want:  map[string][]string{"a": {"a"}, "b": {"b"}},
+			order: []string{"a", "b"},
+		},
+		{
+			name:  "annotations merge and keep order",
+			srcs:  []syncObject{src("a", "shared"), src("b", ""), src("c", "shared")},
+			want:  map[string][]string{"shared": {"a", "c"}, "b": {"b"}},
+			order: []string{"shared", "b"},
+		},
+		{
+			name:   "a policy ignores annotations",
+			srcs:   []syncObject{src("tls", ""), src("api", "shared"), src("db", "")},
+			policy: policy,
+			want:   map[string][]string{"shared": {"tls", "db"}, "api": {"api"}},
+			order:  []string{"shared", "api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := c.groupSources(tt.srcs, tt.policy)
+			got := map[string][]string{}
+			var order []string
+			for _, g := range groups {
+				order = append(order, g.name)
+				if g.policy != tt.policy {
+					t.Errorf("group %v has policy %v, want %v", g.name, g.policy, tt.policy)
+				}
+				for _, s := range g.srcs {
+					got[g.name] = append(got[g.name], s.GetName())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groups = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("group order = %v, want %v", order, tt.order)
+			}
+		})
+	}
+}
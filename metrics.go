@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// We don't vendor the prometheus client so this is just enough of one to
+// serve the text exposition format on /metrics.  Every metric is a "vector"
+// keyed by its label values; metrics without labels just have one series.
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+	summaryType   metricType = "summary"
+)
+
+// syncDurationBuckets are in seconds.  Most syncs are served out of the
+// informer caches and only do a write or two.
+var syncDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms and summaries only
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+type metricVec struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (m *metricVec) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %v wants %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			labelValues: labelValues,
+			buckets:     make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += delta
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	s.count++
+	s.sum += v
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		switch m.typ {
+		case histogramType:
+			for i, upper := range m.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labels(s, "le", formatFloat(upper)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labels(s, "le", "+Inf"), s.count)
+			fallthrough
+		case summaryType:
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labels(s), formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labels(s), s.count)
+		default:
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labels(s), formatFloat(s.value))
+		}
+	}
+}
+
+// labels renders the label set for a series plus any extra name/value pairs
+// (used for the histogram "le" label).
+func (m *metricVec) labels(s *series, extra ...string) string {
+	var pairs []string
+	for i, name := range m.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, s.labelValues[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []*metricVec
+}
+
+func (r *metricsRegistry) register(name, help string, typ metricType, buckets []float64, labelNames ...string) *metricVec {
+	m := &metricVec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	metrics := append([]*metricVec(nil), r.metrics...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+var registry = &metricsRegistry{}
+
+var (
+	syncCount = registry.register("tgik_sync_total",
+		"Number of work items processed, by result.",
+		counterType, nil, "result")
+	namespaceSyncCount = registry.register("tgik_namespace_sync_total",
+		"Number of work items processed per target namespace, by result.",
+		counterType, nil, "namespace", "result")
+	syncDuration = registry.register("tgik_sync_duration_seconds",
+		"How long it takes to process a work item, by kind of item.",
+		histogramType, syncDurationBuckets, "kind")
+	writeCount = registry.register("tgik_writes_total",
+		"Number of writes to copies, by kind, action and result.",
+		counterType, nil, "kind", "action", "result")
+	admissionCount = registry.register("tgik_admission_reviews_total",
+		"Number of admission reviews answered by the webhook, by result.",
+		counterType, nil, "result")
+)
+
+// recordWrite counts a create, update or delete of a copy.
+func recordWrite(kind, action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	writeCount.inc(kind, action, result)
+}
+
+// recordSync counts and times one pass through the sync handler.
+func recordSync(kind, namespace string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	syncCount.inc(result)
+	namespaceSyncCount.inc(namespace, result)
+	syncDuration.observe(time.Since(start).Seconds(), kind)
+}
+
+// workqueueMetricsProvider plugs our registry into the vendored workqueue.
+type workqueueMetricsProvider struct {
+	depth        *metricVec
+	adds         *metricVec
+	latency      *metricVec
+	workDuration *metricVec
+	retries      *metricVec
+}
+
+func newWorkqueueMetricsProvider(r *metricsRegistry) *workqueueMetricsProvider {
+	return &workqueueMetricsProvider{
+		depth: r.register("tgik_workqueue_depth",
+			"Current depth of the workqueue.",
+			gaugeType, nil, "name"),
+		adds: r.register("tgik_workqueue_adds_total",
+			"Total number of adds handled by the workqueue.",
+			counterType, nil, "name"),
+		latency: r.register("tgik_workqueue_queue_latency_microseconds",
+			"How long an item stays in the workqueue before being requested.",
+			summaryType, nil, "name"),
+		workDuration: r.register("tgik_workqueue_work_duration_microseconds",
+			"How long processing an item from the workqueue takes.",
+			summaryType, nil, "name"),
+		retries: r.register("tgik_workqueue_retries_total",
+			"Total number of retries handled by the workqueue.",
+			counterType, nil, "name"),
+	}
+}
+
+func (p *workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return boundMetric{p.depth, name}
+}
+
+func (p *workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return boundMetric{p.adds, name}
+}
+
+func (p *workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return boundMetric{p.latency, name}
+}
+
+func (p *workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return boundMetric{p.workDuration, name}
+}
+
+func (p *workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return boundMetric{p.retries, name}
+}
+
+// boundMetric is a metricVec with the queue name label filled in.
+type boundMetric struct {
+	vec  *metricVec
+	name string
+}
+
+func (m boundMetric) Inc()              { m.vec.add(1, m.name) }
+func (m boundMetric) Dec()              { m.vec.add(-1, m.name) }
+func (m boundMetric) Observe(v float64) { m.vec.observe(v, m.name) }
+
+func init() {
+	// This has to happen before any queue is created.
+	workqueue.SetProvider(newWorkqueueMetricsProvider(registry))
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// `tgik-controller plan --from-dir ./dump` runs the controller against a
+// snapshot of a cluster instead of the real thing and prints what it would
+// change.  The snapshot is any number of YAML or JSON files as written by
+// `kubectl get -o yaml` (single objects, Lists or multiple documents).
+//
+// It is the normal controller with informers that are never started.  We
+// fill their caches from the files, sync every namespace we may write to
+// once and collect the writes instead of doing them.
+
+func runPlan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fromDir := ""
+	fs.StringVar(&fromDir, "from-dir", fromDir, "directory with YAML or JSON dumps of namespaces and objects")
+	syncConfigFile := ""
+	fs.StringVar(&syncConfigFile, "config", syncConfigFile, "YAML or JSON file with the sync configuration; flags override it")
+	syncConfig := defaultSyncConfig()
+	addSyncConfigFlags(fs, &syncConfig)
+	var logFlags logFlags
+	addLogFlags(fs, &logFlags)
+
+	fs.Parse(args)
+	if syncConfigFile != "" {
+		if err := loadSyncConfigFile(syncConfigFile, &syncConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+			return 1
+		}
+		fs.Parse(args)
+	}
+	if err := setupLogger(logFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid logging flags: %v\n", err)
+		return 1
+	}
+	if fromDir == "" {
+		fmt.Fprintln(os.Stderr, "--from-dir is required")
+		return 1
+	}
+	if err := syncConfig.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+
+	// The client is never used to talk to anything.  It's only here so we
+	// can build the informers and adapters the same way main does.
+	client := kubernetes.NewForConfigOrDie(&rest.Config{})
+	sharedInformers := informers.NewSharedInformerFactory(client, 0)
+	kinds, err := newKindAdapters(client, sharedInformers, syncConfig.Kinds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+	namespaceInformer := sharedInformers.Core().V1().Namespaces()
+	configMapInformer := sharedInformers.Core().V1().ConfigMaps()
+	c := NewTGIKController(client, kinds, namespaceInformer, configMapInformer, syncConfig)
+
+	stores := map[string]cache.Indexer{
+		"Namespace": namespaceInformer.Informer().GetIndexer(),
+		"ConfigMap": configMapInformer.Informer().GetIndexer(),
+	}
+	for _, kind := range kinds {
+		stores[kind.Kind] = kind.Indexer
+	}
+	if err := loadSnapshot(fromDir, stores); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading %v: %v\n", fromDir, err)
+		return 1
+	}
+
+	w := newDiffWriter(&c.config)
+	c.enableDryRun(w)
+
+	errs := c.planNamespaces()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	w.print(os.Stdout)
+	if len(errs) != 0 {
+		return 1
+	}
+	return 0
+}
+
+// planNamespaces syncs every namespace we may write to, the same ones a
+// policy change enqueues.  Namespaces that are no longer targets are in
+// there too since the copies they still hold are to be pruned.
+func (c *TGIKController) planNamespaces() []error {
+	namespaces, err := c.namespaceLister.List(labels.Everything())
+	if err != nil {
+		return []error{fmt.Errorf("error listing namespaces: %v", err)}
+	}
+	var errs []error
+	for _, ns := range namespaces {
+		if !c.config.namespaceAllowed(ns.Name) {
+			continue
+		}
+		if err := c.syncNamespace(logger.with("plan", true, "namespace", ns.Name), ns.Name); err != nil {
+			errs = append(errs, fmt.Errorf("error planning namespace %v: %v", ns.Name, err))
+		}
+	}
+	return errs
+}
+
+// loadSnapshot reads every .yaml, .yml and .json file under dir into the
+// store for its kind.  Kinds we have no store for are skipped.
+func loadSnapshot(dir string, stores map[string]cache.Indexer) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := loadSnapshotFile(f, stores); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		return nil
+	})
+}
+
+func loadSnapshotFile(r io.Reader, stores map[string]cache.Indexer) error {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var doc map[string]interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			// Empty document, e.g. a trailing "---".
+			continue
+		}
+		if err := loadSnapshotObject(doc, stores); err != nil {
+			return err
+		}
+	}
+}
+
+func loadSnapshotObject(doc map[string]interface{}, stores map[string]cache.Indexer) error {
+	if kind, _ := doc["kind"].(string); strings.HasSuffix(kind, "List") {
+		items, _ := doc["items"].([]interface{})
+		for _, item := range items {
+			itemDoc, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("unexpected %T in %v items", item, kind)
+			}
+			if err := loadSnapshotObject(itemDoc, stores); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(raw, nil, nil)
+	if runtime.IsNotRegisteredError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	store, ok := stores[gvk.Kind]
+	if !ok {
+		return nil
+	}
+	return store.Add(obj)
+}
+
+// diffWriter collects the writes of a plan run as diffs.
+type diffWriter struct {
+	config  *syncConfig
+	entries []diffEntry
+}
+
+type diffEntry struct {
+	planEntry
+	diff []string
+}
+
+func newDiffWriter(config *syncConfig) *diffWriter {
+	return &diffWriter{config: config}
+}
+
+func (w *diffWriter) create(kind *kindAdapter, obj syncObject) error {
+	return w.add(kind, "create", nil, obj)
+}
+
+func (w *diffWriter) update(kind *kindAdapter, obj syncObject) error {
+	existing, err := kind.get(obj.GetNamespace(), obj.GetName())
+	if err != nil {
+		return err
+	}
+	return w.add(kind, "update", existing, obj)
+}
+
+func (w *diffWriter) delete(kind *kindAdapter, ns, name string) error {
+	existing, err := kind.get(ns, name)
+	if err != nil || existing == nil {
+		return err
+	}
+	return w.add(kind, "delete", existing, nil)
+}
+
+func (w *diffWriter) add(kind *kindAdapter, action string, before, after syncObject) error {
+	beforeDoc, err := planDocument(before)
+	if err != nil {
+		return err
+	}
+	afterDoc, err := planDocument(after)
+	if err != nil {
+		return err
+	}
+	redactSecret(w.config, kind, beforeDoc, afterDoc)
+
+	beforeLines, err := yamlLines(beforeDoc)
+	if err != nil {
+		return err
+	}
+	afterLines, err := yamlLines(afterDoc)
+	if err != nil {
+		return err
+	}
+
+	obj := after
+	if obj == nil {
+		obj = before
+	}
+	entry := diffEntry{
+		planEntry: planEntry{
+			Action:    action,
+			Kind:      kind.Kind,
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+		},
+		diff: diffLines(beforeLines, afterLines),
+	}
+	w.entries = append(w.entries, entry)
+	return nil
+}
+
+func (w *diffWriter) print(out io.Writer) {
+	sort.Slice(w.entries, func(i, j int) bool {
+		a, b := w.entries[i], w.entries[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+
+	counts := map[string]int{}
+	for _, entry := range w.entries {
+		counts[entry.Action]++
+		fmt.Fprintf(out, "%v %v %v/%v\n", entry.Action, entry.Kind, entry.Namespace, entry.Name)
+		for _, line := range entry.diff {
+			fmt.Fprintf(out, "  %v\n", line)
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintf(out, "Plan: %d to create, %d to update, %d to delete.\n", counts["create"], counts["update"], counts["delete"])
+}
+
+// planDocument is the part of an object worth showing in a diff: what we
+// replicate plus the name, labels and annotations.
+func planDocument(obj syncObject) (map[string]interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	doc, err := content(obj)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]interface{}{
+		"name":      obj.GetName(),
+		"namespace": obj.GetNamespace(),
+	}
+	if len(obj.GetLabels()) != 0 {
+		metadata["labels"] = obj.GetLabels()
+	}
+	if len(obj.GetAnnotations()) != 0 {
+		// A copy of the map since redactSecret works on the document and obj
+		// may well come straight out of a cache.
+		annotations := map[string]interface{}{}
+		for k, v := range obj.GetAnnotations() {
+			annotations[k] = v
+		}
+		metadata["annotations"] = annotations
+	}
+	doc["metadata"] = metadata
+	return doc, nil
+}
+
+// redactSecret replaces secret values so plans are safe to share.  That
+// covers data as well as every annotation that isn't one of ours: they are
+// copied from the source as is, and kubectl apply for one leaves the whole
+// secret in kubectl.kubernetes.io/last-applied-configuration.  Values that
+// are about to change are marked as such.
+func redactSecret(cfg *syncConfig, kind *kindAdapter, before, after map[string]interface{}) {
+	if kind.Kind != "Secret" {
+		return
+	}
+	redactValues(field(before, "data"), field(after, "data"), func(string) bool { return false })
+	redactValues(field(field(before, "metadata"), "annotations"), field(field(after, "metadata"), "annotations"), cfg.isOurAnnotation)
+}
+
+// field returns doc[name] if it's a map.
+func field(doc map[string]interface{}, name string) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	m, _ := doc[name].(map[string]interface{})
+	return m
+}
+
+// redactValues replaces the values of every key in before and after unless
+// keep says otherwise.
+func redactValues(before, after map[string]interface{}, keep func(key string) bool) {
+	for key, value := range after {
+		if keep(key) {
+			continue
+		}
+		if old, ok := before[key]; ok && old != value {
+			after[key] = "<redacted, changed>"
+		} else {
+			after[key] = "<redacted>"
+		}
+	}
+	for key := range before {
+		if !keep(key) {
+			before[key] = "<redacted>"
+		}
+	}
+}
+
+func yamlLines(doc map[string]interface{}) ([]string, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	raw, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n"), nil
+}
+
+// diffLines is a plain longest common subsequence diff.  The documents are
+// small so the quadratic table is fine.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+ "+b[j])
+	}
+	return lines
+}
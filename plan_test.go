@@ -0,0 +1,205 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want []string
+	}{
+		{
+			name: "both empty",
+		},
+		{
+			name: "create",
+			b:    []string{"x", "y"},
+			want: []string{"+ x", "+ y"},
+		},
+		{
+			name: "delete",
+			a:    []string{"x", "y"},
+			want: []string{"- x", "- y"},
+		},
+		{
+			name: "unchanged",
+			a:    []string{"x", "y"},
+			b:    []string{"x", "y"},
+			want: []string{"  x", "  y"},
+		},
+		{
+			name: "change in the middle",
+			a:    []string{"a", "b", "c"},
+			b:    []string{"a", "B", "c"},
+			want: []string{"  a", "- b", "+ B", "  c"},
+		},
+		{
+			name: "insert and remove",
+			a:    []string{"a", "b", "c", "d"},
+			b:    []string{"a", "c", "d", "e"},
+			want: []string{"  a", "- b", "  c", "  d", "+ e"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	cfg := defaultSyncConfig()
+	tests := []struct {
+		name       string
+		kind       string
+		before     map[string]interface{}
+		after      map[string]interface{}
+		wantBefore map[string]interface{}
+		wantAfter  map[string]interface{}
+	}{
+		{
+			name: "data",
+			kind: "Secret",
+			before: map[string]interface{}{
+				"data": map[string]interface{}{"same": "x", "changed": "y", "removed": "z"},
+			},
+			after: map[string]interface{}{
+				"data": map[string]interface{}{"same": "x", "changed": "Y", "added": "w"},
+			},
+			wantBefore: map[string]interface{}{
+				"data": map[string]interface{}{"same": "<redacted>", "changed": "<redacted>", "removed": "<redacted>"},
+			},
+			wantAfter: map[string]interface{}{
+				"data": map[string]interface{}{"same": "<redacted>", "changed": "<redacted, changed>", "added": "<redacted>"},
+			},
+		},
+		{
+			name: "foreign annotations",
+			kind: "Secret",
+			after: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						cfg.Annotation:             "true",
+						cfg.sourceNameAnnotation(): "db",
+						"kubectl.kubernetes.io/last-applied-configuration": `{"data":{"password":"aHVudGVyMg=="}}`,
+					},
+				},
+			},
+			wantAfter: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						cfg.Annotation:             "true",
+						cfg.sourceNameAnnotation(): "db",
+						"kubectl.kubernetes.io/last-applied-configuration": "<redacted>",
+					},
+				},
+			},
+		},
+		{
+			name:      "other kinds are left alone",
+			kind:      "ConfigMap",
+			after:     map[string]interface{}{"data": map[string]interface{}{"key": "value"}},
+			wantAfter: map[string]interface{}{"data": map[string]interface{}{"key": "value"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redactSecret(&cfg, &kindAdapter{Kind: tt.kind}, tt.before, tt.after)
+			if !reflect.DeepEqual(tt.before, tt.wantBefore) {
+				t.Errorf("before = %v, want %v", tt.before, tt.wantBefore)
+			}
+			if !reflect.DeepEqual(tt.after, tt.wantAfter) {
+				t.Errorf("after = %v, want %v", tt.after, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestDiffWriterRedactsLastAppliedConfiguration(t *testing.T) {
+	cfg := defaultSyncConfig()
+	secret := func(password, encoded string) *apicorev1.Secret {
+		return &apicorev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "db",
+				Namespace: "team-a",
+				Annotations: map[string]string{
+					cfg.Annotation: "true",
+					"kubectl.kubernetes.io/last-applied-configuration": `{"apiVersion":"v1","kind":"Secret","data":{"password":"` + encoded + `"}}`,
+				},
+			},
+			Data: map[string][]byte{"password": []byte(password)},
+		}
+	}
+	before := secret("hunter2", "aHVudGVyMg==")
+	after := secret("swordfish", "c3dvcmRmaXNo")
+
+	w := newDiffWriter(&cfg)
+	if err := w.add(&kindAdapter{Kind: "Secret"}, "update", before, after); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(w.entries))
+	}
+	diff := strings.Join(w.entries[0].diff, "\n")
+	for _, value := range []string{"hunter2", "aHVudGVyMg", "swordfish", "c3dvcmRmaXNo"} {
+		if strings.Contains(diff, value) {
+			t.Errorf("diff contains %q:\n%v", value, diff)
+		}
+	}
+	if !strings.Contains(diff, "<redacted, changed>") {
+		t.Errorf("diff doesn't mark the change:\n%v", diff)
+	}
+	// The objects themselves must not have been touched.
+	if got := before.Annotations["kubectl.kubernetes.io/last-applied-configuration"]; !strings.Contains(got, "aHVudGVyMg==") {
+		t.Errorf("redacting changed the object: %q", got)
+	}
+}
+
+func TestPlanPrunesFormerTargets(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   cfg.SourceNamespace,
+			UID:         "uid-db",
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+		Data: map[string][]byte{"password": []byte("hunter2")},
+	}
+	stale := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "team-a",
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+		Data: src.Data,
+	}
+	cfg.stampProvenance(stale, src)
+	// team-a lost its annotation, team-b never had one.
+	teamA := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	teamB := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}}
+
+	c, _ := newTestController(t, src, stale, teamA, teamB)
+	w := newDiffWriter(&c.config)
+	c.enableDryRun(w)
+	if errs := c.planNamespaces(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	var got []planEntry
+	for _, entry := range w.entries {
+		got = append(got, entry.planEntry)
+	}
+	want := []planEntry{{Action: "delete", Kind: "Secret", Namespace: "team-a", Name: "db"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("plan = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// A SecretSyncPolicy is a typed alternative to annotating source secrets.
+// The vendored client-go has no dynamic client to work with
+// ThirdPartyResources so a policy is a ConfigMap in the source namespace
+// carrying the policy label, with the spec as YAML under the "spec" key:
+//
+//	apiVersion: v1
+//	kind: ConfigMap
+//	metadata:
+//	  name: payments
+//	  namespace: secretsync
+//	  labels:
+//	    eightypercent.net/secretsync-policy: "true"
+//	data:
+//	  spec: |
+//	    secrets: [db-credentials, tls]
+//	    namespaceSelector: team=payments
+//	    keys:
+//	      exclude: ["*.key"]
+//	      rename: {ca.crt: payments-ca.crt}
+//	    targetNames: {tls: payments-tls}
+//	    prune: false
+//
+// The controller writes the per-namespace sync state back under "status".
+const (
+	policyKind      = "SecretSyncPolicy"
+	policySpecKey   = "spec"
+	policyStatusKey = "status"
+)
+
+// policyStatusInterval is how often policy statuses get written out.
+const policyStatusInterval = 10 * time.Second
+
+// Policy phases, per namespace.
+const (
+	policyPhasePending = "Pending"
+	policyPhaseSynced  = "Synced"
+	policyPhaseFailed  = "Failed"
+)
+
+// policyLabel marks ConfigMaps in the source namespace that hold a policy.
+func (cfg *syncConfig) policyLabel() string {
+	return cfg.Annotation + "-policy"
+}
+
+// policyAnnotation records on a copy which policy asked for it.
+func (cfg *syncConfig) policyAnnotation() string {
+	return cfg.Annotation + "-policy"
+}
+
+type syncPolicySpec struct {
+	// Secrets are the names of the secrets in the source namespace to copy.
+	Secrets []string `json:"secrets"`
+	// NamespaceSelector is a label selector picking the target namespaces.
+	// Empty selects every namespace the config allows.  Namespaces don't
+	// need to carry the opt-in annotation to be selected by a policy.
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// Keys filters and renames the keys of the secrets as they get copied.
+	Keys keyFilter `json:"keys,omitempty"`
+	// TargetNames maps secret names to the names their copies get.  Secrets
+	// not in here keep their name.
+	TargetNames map[string]string `json:"targetNames,omitempty"`
+	// Prune decides if copies are deleted once their secret is deleted or
+	// dropped from the policy.  Defaults to true.
+	Prune *bool `json:"prune,omitempty"`
+}
+
+type syncPolicy struct {
+	Name     string
+	Spec     syncPolicySpec
+	selector labels.Selector
+}
+
+func (p *syncPolicy) prune() bool {
+	return p.Spec.Prune == nil || *p.Spec.Prune
+}
+
+func (p *syncPolicy) selects(ns *apicorev1.Namespace) bool {
+	return p.selector.Matches(labels.Set(ns.Labels))
+}
+
+func (p *syncPolicy) namesSecret(name string) bool {
+	for _, secret := range p.Spec.Secrets {
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePolicy(cm *apicorev1.ConfigMap) (*syncPolicy, error) {
+	raw, ok := cm.Data[policySpecKey]
+	if !ok {
+		return nil, fmt.Errorf("no %q key", policySpecKey)
+	}
+	p := &syncPolicy{Name: cm.Name}
+	if err := yaml.Unmarshal([]byte(raw), &p.Spec); err != nil {
+		return nil, fmt.Errorf("error parsing spec: %v", err)
+	}
+	if err := p.Spec.Keys.validate(); err != nil {
+		return nil, err
+	}
+	for _, targetName := range p.Spec.TargetNames {
+		if err := validateTargetName(targetName); err != nil {
+			return nil, err
+		}
+	}
+	selector, err := labels.Parse(p.Spec.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %v", err)
+	}
+	p.selector = selector
+	return p, nil
+}
+
+// policyCache holds the policies parsed so far, by ConfigMap name.  Policies
+// are looked up for every namespace on every source change, so parsing their
+// YAML each time adds up.  An entry is reused as long as the spec it was
+// parsed from hasn't changed, which also keeps our own status writes from
+// invalidating it.
+type policyCache struct {
+	mu      sync.Mutex
+	entries map[string]policyCacheEntry
+}
+
+type policyCacheEntry struct {
+	spec   string
+	hasKey bool
+	policy *syncPolicy
+	err    error
+}
+
+func newPolicyCache() *policyCache {
+	return &policyCache{
+		entries: map[string]policyCacheEntry{},
+	}
+}
+
+// parse is parsePolicy, cached.  The policy it returns is shared and must
+// not be modified.
+func (pc *policyCache) parse(cm *apicorev1.ConfigMap) (*syncPolicy, error) {
+	spec, hasKey := cm.Data[policySpecKey]
+	pc.mu.Lock()
+	entry, ok := pc.entries[cm.Name]
+	pc.mu.Unlock()
+	if ok && entry.spec == spec && entry.hasKey == hasKey {
+		return entry.policy, entry.err
+	}
+
+	p, err := parsePolicy(cm)
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.entries[cm.Name] = policyCacheEntry{spec: spec, hasKey: hasKey, policy: p, err: err}
+	return p, err
+}
+
+// retain forgets everything about policies that no longer exist.
+func (pc *policyCache) retain(policies map[string]bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for name := range pc.entries {
+		if !policies[name] {
+			delete(pc.entries, name)
+		}
+	}
+}
+
+func (c *TGIKController) isPolicyConfigMap(cm *apicorev1.ConfigMap) bool {
+	_, ok := cm.Labels[c.config.policyLabel()]
+	return ok && cm.Namespace == c.config.SourceNamespace
+}
+
+// listPolicyConfigMaps returns the policy ConfigMaps sorted by name.
+func (c *TGIKController) listPolicyConfigMaps() ([]*apicorev1.ConfigMap, error) {
+	rawConfigMaps, err := c.policyLister.ConfigMaps(c.config.SourceNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var configMaps []*apicorev1.ConfigMap
+	for _, cm := range rawConfigMaps {
+		if c.isPolicyConfigMap(cm) {
+			configMaps = append(configMaps, cm)
+		}
+	}
+	sort.Slice(configMaps, func(i, j int) bool { return configMaps[i].Name < configMaps[j].Name })
+	return configMaps, nil
+}
+
+// getPolicies returns the valid policies sorted by name.  When two policies
+// ask for the same secret in the same namespace the first one wins.  Broken
+// policies are skipped; their status says why.
+func (c *TGIKController) getPolicies() []*syncPolicy {
+	configMaps, err := c.listPolicyConfigMaps()
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error listing policies: %v", err))
+		return nil
+	}
+	var policies []*syncPolicy
+	for _, cm := range configMaps {
+		p, err := c.policies.parse(cm)
+		if err != nil {
+			continue
+		}
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+func (c *TGIKController) getPolicy(name string) *syncPolicy {
+	for _, p := range c.getPolicies() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *TGIKController) policiesForNamespace(ns *apicorev1.Namespace) []*syncPolicy {
+	var policies []*syncPolicy
+	for _, p := range c.getPolicies() {
+		if p.selects(ns) {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// policyNamesSecret returns true if any policy copies the named source secret.
+func (c *TGIKController) policyNamesSecret(name string) bool {
+	for _, p := range c.getPolicies() {
+		if p.namesSecret(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayPrune returns false for copies made by a policy that asks to keep them.
+func (c *TGIKController) mayPrune(obj metav1.Object) bool {
+	name, ok := obj.GetAnnotations()[c.config.policyAnnotation()]
+	if !ok {
+		return true
+	}
+	p := c.getPolicy(name)
+	// If the policy itself is gone there is nobody left asking us to keep
+	// the copy.
+	return p == nil || p.prune()
+}
+
+// policyIsRelevant is used for adds and deletes of ConfigMaps.
+func (c *TGIKController) policyIsRelevant(obj interface{}) bool {
+	cm, ok := unwrapTombstone(obj).(*apicorev1.ConfigMap)
+	return ok && c.isPolicyConfigMap(cm)
+}
+
+// policyUpdateIsRelevant ignores our own status writes.
+func (c *TGIKController) policyUpdateIsRelevant(oldObj, newObj interface{}) bool {
+	oldCM, ok := oldObj.(*apicorev1.ConfigMap)
+	if !ok {
+		return false
+	}
+	newCM, ok := newObj.(*apicorev1.ConfigMap)
+	if !ok {
+		return false
+	}
+	oldPolicy, newPolicy := c.isPolicyConfigMap(oldCM), c.isPolicyConfigMap(newCM)
+	if !oldPolicy && !newPolicy {
+		return false
+	}
+	return oldPolicy != newPolicy || oldCM.Data[policySpecKey] != newCM.Data[policySpecKey]
+}
+
+// enqueuePolicy reconciles every namespace we may sync to when a policy
+// changes.  The namespaces a policy stops selecting (or all of them, when it
+// is deleted) aren't targets anymore but still need their copies pruned, and
+// by now we can't tell which ones the policy used to select.  That is more
+// work than strictly needed but policies change rarely.
+func (c *TGIKController) enqueuePolicy(obj interface{}) {
+	namespaces, err := c.namespaceLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, ns := range namespaces {
+		if c.config.namespaceAllowed(ns.Name) {
+			c.queue.Add(workItem{Namespace: ns.Name})
+		}
+	}
+}
+
+// syncPolicyStatus is what goes under the "status" key of a policy.
+type syncPolicyStatus struct {
+	// Error is set if the spec can't be used at all.
+	Error      string                         `json:"error,omitempty"`
+	Namespaces map[string]namespaceSyncStatus `json:"namespaces,omitempty"`
+}
+
+type namespaceSyncStatus struct {
+	Phase  string            `json:"phase"`
+	Synced []string          `json:"synced,omitempty"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// policyStatusTracker collects sync results per policy as workers go.  They
+// are written out in batches by writePolicyStatus so a busy controller
+// doesn't write a policy for every item it syncs.
+type policyStatusTracker struct {
+	mu sync.Mutex
+	// results maps policy -> namespace -> secret -> error message, with ""
+	// meaning synced.
+	results map[string]map[string]map[string]string
+}
+
+func newPolicyStatusTracker() *policyStatusTracker {
+	return &policyStatusTracker{
+		results: map[string]map[string]map[string]string{},
+	}
+}
+
+func (t *policyStatusTracker) set(policy, ns, secret, message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.results[policy] == nil {
+		t.results[policy] = map[string]map[string]string{}
+	}
+	if t.results[policy][ns] == nil {
+		t.results[policy][ns] = map[string]string{}
+	}
+	t.results[policy][ns][secret] = message
+}
+
+func (t *policyStatusTracker) get(policy, ns, secret string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	message, ok := t.results[policy][ns][secret]
+	return message, ok
+}
+
+// retain forgets everything about policies that no longer exist.
+func (t *policyStatusTracker) retain(policies map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.results {
+		if !policies[name] {
+			delete(t.results, name)
+		}
+	}
+}
+
+// recordPolicyResults notes how the named secrets fared in ns for every policy
+// that selects ns.  results has the outcome of every write we tried, keyed
+// by the name of the source.  A secret a policy asks for that we didn't try
+// to write doesn't exist.
+func (c *TGIKController) recordPolicyResults(ns *apicorev1.Namespace, results map[string]error, names []string) {
+	for _, p := range c.policiesForNamespace(ns) {
+		for _, name := range names {
+			if !p.namesSecret(name) {
+				continue
+			}
+			message := ""
+			if err, ok := results[name]; !ok {
+				message = fmt.Sprintf("source secret %v not found in %v", name, strings.Join(c.config.sourceNamespaces(), ", "))
+			} else if err != nil {
+				message = err.Error()
+			}
+			c.policyStatus.set(p.Name, ns.Name, name, message)
+		}
+	}
+}
+
+// policyStatusFor works out the status of one policy from what has been
+// recorded so far.
+func (c *TGIKController) policyStatusFor(cm *apicorev1.ConfigMap, targetNamespaces []*apicorev1.Namespace) syncPolicyStatus {
+	p, err := c.policies.parse(cm)
+	if err != nil {
+		return syncPolicyStatus{Error: err.Error()}
+	}
+	status := syncPolicyStatus{Namespaces: map[string]namespaceSyncStatus{}}
+	for _, ns := range targetNamespaces {
+		if !p.selects(ns) {
+			continue
+		}
+		nsStatus := namespaceSyncStatus{Phase: policyPhaseSynced}
+		for _, secret := range p.Spec.Secrets {
+			message, ok := c.policyStatus.get(p.Name, ns.Name, secret)
+			switch {
+			case !ok:
+				if nsStatus.Phase == policyPhaseSynced {
+					nsStatus.Phase = policyPhasePending
+				}
+			case message == "":
+				nsStatus.Synced = append(nsStatus.Synced, secret)
+			default:
+				if nsStatus.Failed == nil {
+					nsStatus.Failed = map[string]string{}
+				}
+				nsStatus.Failed[secret] = message
+				nsStatus.Phase = policyPhaseFailed
+			}
+		}
+		status.Namespaces[ns.Name] = nsStatus
+	}
+	return status
+}
+
+// writePolicyStatus writes the status of every policy that changed since the
+// last time around.
+func (c *TGIKController) writePolicyStatus() {
+	configMaps, err := c.listPolicyConfigMaps()
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error listing policies: %v", err))
+		return
+	}
+	targetNamespaces, err := c.getTargetNamespaces()
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	names := map[string]bool{}
+	for _, cm := range configMaps {
+		names[cm.Name] = true
+
+		status := c.policyStatusFor(cm, targetNamespaces)
+		raw, err := yaml.Marshal(status)
+		if err != nil {
+			runtime.HandleError(fmt.Errorf("error encoding status of %v %v: %v", policyKind, cm.Name, err))
+			continue
+		}
+		if cm.Data[policyStatusKey] == string(raw) {
+			continue
+		}
+
+		objInf, err := scheme.Scheme.DeepCopy(cm)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+		newCM := objInf.(*apicorev1.ConfigMap)
+		if newCM.Data == nil {
+			newCM.Data = map[string]string{}
+		}
+		newCM.Data[policyStatusKey] = string(raw)
+		logger.debug("updating policy status", "kind", policyKind, "namespace", cm.Namespace, "name", cm.Name)
+		if _, err := c.configMapGetter.ConfigMaps(cm.Namespace).Update(newCM); err != nil {
+			runtime.HandleError(fmt.Errorf("error updating status of %v %v: %v", policyKind, cm.Name, err))
+		}
+	}
+	c.policyStatus.retain(names)
+	c.policies.retain(names)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestPolicyCache(t *testing.T) {
+	pc := newPolicyCache()
+	cm := &apicorev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", ResourceVersion: "1"},
+		Data:       map[string]string{policySpecKey: "secrets: [db]\n"},
+	}
+	first, err := pc.parse(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A status write bumps the resourceVersion but leaves the spec alone.
+	cm.ResourceVersion = "2"
+	cm.Data[policyStatusKey] = "namespaces: {}\n"
+	if p, err := pc.parse(cm); err != nil || p != first {
+		t.Errorf("parse() after status write = %p, %v; want cached %p", p, err, first)
+	}
+
+	cm.Data[policySpecKey] = "secrets: [db, tls]\n"
+	p, err := pc.parse(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == first || len(p.Spec.Secrets) != 2 {
+		t.Errorf("parse() after spec change = %+v, want fresh policy with 2 secrets", p.Spec)
+	}
+
+	cm.Data[policySpecKey] = "namespaceSelector: \"team in (\"\n"
+	if _, err := pc.parse(cm); err == nil {
+		t.Errorf("parse() of broken spec succeeded")
+	}
+	delete(cm.Data, policySpecKey)
+	if _, err := pc.parse(cm); err == nil {
+		t.Errorf("parse() without spec succeeded")
+	}
+
+	pc.retain(map[string]bool{})
+	if len(pc.entries) != 0 {
+		t.Errorf("retain() kept %d entries", len(pc.entries))
+	}
+}
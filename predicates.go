@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The informers hand us every object and namespace in the cluster.  Most of
+// them (service account tokens, helm releases, ...) have nothing to do with
+// us so these predicates keep that churn from ever reaching the work queue.
+
+func (cfg *syncConfig) hasSyncAnnotation(obj metav1.Object) bool {
+	_, ok := obj.GetAnnotations()[cfg.Annotation]
+	return ok
+}
+
+// isOurAnnotation returns true for the sync annotation and the ones we stamp
+// on copies, which never hold anything secret.
+func (cfg *syncConfig) isOurAnnotation(key string) bool {
+	return key == cfg.Annotation || strings.HasPrefix(key, cfg.Annotation+"-")
+}
+
+// unwrapTombstone digs the last known state out of a DeletedFinalStateUnknown.
+// We get one of these when the watch missed the delete and the informer only
+// noticed during a re-list.
+func unwrapTombstone(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+func objectFromObj(obj interface{}) (syncObject, bool) {
+	o, ok := unwrapTombstone(obj).(syncObject)
+	return o, ok
+}
+
+func namespaceFromObj(obj interface{}) (*apicorev1.Namespace, bool) {
+	ns, ok := unwrapTombstone(obj).(*apicorev1.Namespace)
+	return ns, ok
+}
+
+// isSyncedObject returns true for objects we care about: annotated objects,
+// secrets a policy asks for and our copies.
+func (c *TGIKController) isSyncedObject(kind string, o metav1.Object) bool {
+	if c.config.hasSyncAnnotation(o) || c.config.isOwnedCopy(o) {
+		return true
+	}
+	return kind == "Secret" && c.config.isSourceNamespace(o.GetNamespace()) && c.policyNamesSecret(o.GetName())
+}
+
+// objectIsRelevant is used for adds and deletes.
+func (c *TGIKController) objectIsRelevant(kind string, obj interface{}) bool {
+	o, ok := objectFromObj(obj)
+	if !ok {
+		return false
+	}
+	return c.isSyncedObject(kind, o)
+}
+
+func (c *TGIKController) objectUpdateIsRelevant(kind string, oldObj, newObj interface{}) bool {
+	oldO, ok := objectFromObj(oldObj)
+	if !ok {
+		return false
+	}
+	newO, ok := objectFromObj(newObj)
+	if !ok {
+		return false
+	}
+
+	oldSynced, newSynced := c.isSyncedObject(kind, oldO), c.isSyncedObject(kind, newO)
+	if !oldSynced && !newSynced {
+		return false
+	}
+	if oldSynced != newSynced {
+		return true
+	}
+
+	// A periodic resync shows up as an update where nothing changed.  Let it
+	// through so that we still reconcile every so often as a safety net.
+	if oldO.GetResourceVersion() == newO.GetResourceVersion() {
+		return true
+	}
+
+	if !reflect.DeepEqual(oldO.GetLabels(), newO.GetLabels()) ||
+		!reflect.DeepEqual(oldO.GetAnnotations(), newO.GetAnnotations()) {
+		return true
+	}
+	oldContent, err := content(oldO)
+	if err != nil {
+		return true
+	}
+	newContent, err := content(newO)
+	if err != nil {
+		return true
+	}
+	return !reflect.DeepEqual(oldContent, newContent)
+}
+
+// namespaceIsRelevant is used for adds.  Namespaces we'd never sync to (which
+// includes the source namespace) are dropped right away.
+func (c *TGIKController) namespaceIsRelevant(obj interface{}) bool {
+	ns, ok := namespaceFromObj(obj)
+	if !ok {
+		return false
+	}
+	return c.isTargetNamespace(ns)
+}
+
+func (c *TGIKController) namespaceUpdateIsRelevant(oldObj, newObj interface{}) bool {
+	oldNS, ok := namespaceFromObj(oldObj)
+	if !ok {
+		return false
+	}
+	newNS, ok := namespaceFromObj(newObj)
+	if !ok {
+		return false
+	}
+	if !c.config.namespaceAllowed(newNS.Name) {
+		return false
+	}
+
+	oldAnnotated, newAnnotated := c.config.hasSyncAnnotation(oldNS), c.config.hasSyncAnnotation(newNS)
+	if oldAnnotated != newAnnotated {
+		return true
+	}
+	if !c.isTargetNamespace(oldNS) && !c.isTargetNamespace(newNS) {
+		return false
+	}
+	// Label changes can change which objects and policies select this
+	// namespace, and templates can use both labels and annotations.  Same as
+	// with objects, let resyncs of targets through.
+	return oldNS.ResourceVersion == newNS.ResourceVersion ||
+		!reflect.DeepEqual(oldNS.Labels, newNS.Labels) ||
+		!reflect.DeepEqual(oldNS.Annotations, newNS.Annotations)
+}
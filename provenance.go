@@ -0,0 +1,80 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// controllerName identifies copies written by this controller.  Anything in a
+// target namespace without our stamp belongs to somebody else and we leave it
+// alone.
+const controllerName = "tgik-controller"
+
+// Provenance annotations stamped on every copy so we can prove we created it.
+//
+// Copies made before we stamped provenance only carry the sync annotation
+// they got from their source.  After an upgrade such a legacy copy is adopted
+// (updated and from then on stamped) when it has the name of an annotated
+// source and still holds exactly its content.  Anything else, including
+// legacy copies whose source is gone, is left alone unless adoptExisting is
+// set, in which case every legacy copy is treated as ours just like the old
+// controller did.
+
+func (cfg *syncConfig) managedByAnnotation() string {
+	return cfg.Annotation + "-managed-by"
+}
+
+func (cfg *syncConfig) sourceNamespaceAnnotation() string {
+	return cfg.Annotation + "-source-namespace"
+}
+
+func (cfg *syncConfig) sourceNameAnnotation() string {
+	return cfg.Annotation + "-source-name"
+}
+
+func (cfg *syncConfig) sourceUIDAnnotation() string {
+	return cfg.Annotation + "-source-uid"
+}
+
+// stampProvenance records where a copy came from.  The copy must already have
+// a non-nil annotation map.
+func (cfg *syncConfig) stampProvenance(copy, src metav1.Object) {
+	annotations := copy.GetAnnotations()
+	annotations[cfg.managedByAnnotation()] = controllerName
+	annotations[cfg.sourceNamespaceAnnotation()] = src.GetNamespace()
+	annotations[cfg.sourceNameAnnotation()] = src.GetName()
+	annotations[cfg.sourceUIDAnnotation()] = string(src.GetUID())
+}
+
+// isOwnedCopy returns true only for objects we created from our source
+// namespaces.  Composite copies list one source namespace per contributor.
+func (cfg *syncConfig) isOwnedCopy(obj metav1.Object) bool {
+	annotations := obj.GetAnnotations()
+	if annotations[cfg.managedByAnnotation()] != controllerName {
+		return false
+	}
+	namespaces := splitList(annotations[cfg.sourceNamespaceAnnotation()])
+	if len(namespaces) == 0 {
+		return false
+	}
+	for _, ns := range namespaces {
+		if !cfg.isSourceNamespace(ns) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLegacyCopy returns true for objects that look like they were copied by a
+// version of the controller that didn't stamp provenance yet.
+func (cfg *syncConfig) isLegacyCopy(obj metav1.Object) bool {
+	if _, ok := obj.GetAnnotations()[cfg.managedByAnnotation()]; ok {
+		return false
+	}
+	return cfg.hasSyncAnnotation(obj) && !cfg.isSourceNamespace(obj.GetNamespace())
+}
+
+// isManagedCopy returns true for copies we may update and prune without
+// looking at their content: our own, and legacy ones with adoptExisting.
+func (cfg *syncConfig) isManagedCopy(obj metav1.Object) bool {
+	return cfg.isOwnedCopy(obj) || cfg.AdoptExisting && cfg.isLegacyCopy(obj)
+}
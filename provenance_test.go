@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestMayAdopt(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   cfg.SourceNamespace,
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+		Data: map[string][]byte{"password": []byte("hunter2")},
+	}
+	legacy := func(name, password string) *apicorev1.Secret {
+		return &apicorev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "team-a",
+				Annotations: map[string]string{cfg.Annotation: "true"},
+			},
+			Data: map[string][]byte{"password": []byte(password)},
+		}
+	}
+	owned := legacy("db", "hunter2")
+	cfg.stampProvenance(owned, src)
+	foreign := legacy("db", "hunter2")
+	delete(foreign.Annotations, cfg.Annotation)
+
+	tests := []struct {
+		name     string
+		existing *apicorev1.Secret
+		adoptAll bool
+		want     bool
+	}{
+		{"same content", legacy("db", "hunter2"), false, true},
+		{"changed content", legacy("db", "old"), false, false},
+		{"changed content, adopt existing", legacy("db", "old"), true, true},
+		{"other name", legacy("shared-db", "hunter2"), false, false},
+		{"already ours", owned, false, false},
+		{"not annotated", foreign, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &TGIKController{config: cfg}
+			c.config.AdoptExisting = tt.adoptAll
+			d := &desiredCopy{name: tt.existing.Name, srcs: []syncObject{src}}
+			if got := c.mayAdopt(tt.existing, d); got != tt.want {
+				t.Errorf("mayAdopt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
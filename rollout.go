@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1beta1 "k8s.io/client-go/kubernetes/typed/apps/v1beta1"
+	extensionsv1beta1 "k8s.io/client-go/kubernetes/typed/extensions/v1beta1"
+	listerappsv1beta1 "k8s.io/client-go/listers/apps/v1beta1"
+	listerextensionsv1beta1 "k8s.io/client-go/listers/extensions/v1beta1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Pods only pick up new secret values when they restart (env vars) or
+// eventually (volumes).  With rolloutOnChange we roll the Deployments,
+// DaemonSets and StatefulSets that use a synced secret whenever we update it.
+// We do it the way `kubectl rollout restart` does, by changing an annotation
+// on the pod template.  Its value is a hash over the content hashes of all of
+// the synced secrets the workload uses, so it only changes when one of them
+// does.
+//
+// Workloads that have never been rolled by us (no annotation yet) are only
+// rolled when we actually update one of their secrets, not when we notice
+// they use one.  If rolling one fails right after an update we remember it,
+// since by the time the secret is retried it looks up to date and the
+// workload still has no annotation.  That memory doesn't survive a restart.
+
+const reasonRolledOut = "RolledOut"
+
+func (cfg *syncConfig) rolloutHashAnnotation() string {
+	return cfg.Annotation + "-rollout-hash"
+}
+
+// workloadRoller finds and rolls the workloads in a namespace.  It is only
+// set up when rolloutOnChange is on so we don't cache every workload in the
+// cluster for nothing.
+type workloadRoller struct {
+	deploymentGetter  extensionsv1beta1.DeploymentsGetter
+	daemonSetGetter   extensionsv1beta1.DaemonSetsGetter
+	statefulSetGetter appsv1beta1.StatefulSetsGetter
+
+	deploymentLister  listerextensionsv1beta1.DeploymentLister
+	daemonSetLister   listerextensionsv1beta1.DaemonSetLister
+	statefulSetLister listerappsv1beta1.StatefulSetLister
+	synced            []cache.InformerSynced
+
+	mu sync.Mutex
+	// failed holds the workloads we couldn't roll, by kind/namespace/name.
+	failed sets.String
+}
+
+// workload is the part of a Deployment, DaemonSet or StatefulSet we care
+// about.
+type workload struct {
+	kind     string
+	obj      metav1.Object
+	template *apicorev1.PodTemplateSpec
+	patch    func(data []byte) error
+}
+
+// enableRollouts sets up the informers for workloads.  It has to be called
+// before the informer factory is started.
+func (c *TGIKController) enableRollouts(client *kubernetes.Clientset, sharedInformers informers.SharedInformerFactory) {
+	deployments := sharedInformers.Extensions().V1beta1().Deployments()
+	daemonSets := sharedInformers.Extensions().V1beta1().DaemonSets()
+	statefulSets := sharedInformers.Apps().V1beta1().StatefulSets()
+	c.rollouts = &workloadRoller{
+		deploymentGetter:  client.ExtensionsV1beta1(),
+		daemonSetGetter:   client.ExtensionsV1beta1(),
+		statefulSetGetter: client.AppsV1beta1(),
+		deploymentLister:  deployments.Lister(),
+		daemonSetLister:   daemonSets.Lister(),
+		statefulSetLister: statefulSets.Lister(),
+		synced: []cache.InformerSynced{
+			deployments.Informer().HasSynced,
+			daemonSets.Informer().HasSynced,
+			statefulSets.Informer().HasSynced,
+		},
+		failed: sets.NewString(),
+	}
+}
+
+func (w workload) key() string {
+	return w.kind + "/" + w.obj.GetNamespace() + "/" + w.obj.GetName()
+}
+
+// setFailed records whether rolling w failed.
+func (r *workloadRoller) setFailed(w workload, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if failed {
+		r.failed.Insert(w.key())
+	} else {
+		r.failed.Delete(w.key())
+	}
+}
+
+func (r *workloadRoller) hasFailed(w workload) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed.Has(w.key())
+}
+
+func (r *workloadRoller) list(ns string) ([]workload, error) {
+	var workloads []workload
+	deployments, err := r.deploymentLister.Deployments(ns).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments {
+		name := d.Name
+		workloads = append(workloads, workload{
+			kind:     "Deployment",
+			obj:      d,
+			template: &d.Spec.Template,
+			patch: func(data []byte) error {
+				_, err := r.deploymentGetter.Deployments(ns).Patch(name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+	daemonSets, err := r.daemonSetLister.DaemonSets(ns).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range daemonSets {
+		name := d.Name
+		workloads = append(workloads, workload{
+			kind:     "DaemonSet",
+			obj:      d,
+			template: &d.Spec.Template,
+			patch: func(data []byte) error {
+				_, err := r.daemonSetGetter.DaemonSets(ns).Patch(name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+	statefulSets, err := r.statefulSetLister.StatefulSets(ns).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range statefulSets {
+		name := s.Name
+		workloads = append(workloads, workload{
+			kind:     "StatefulSet",
+			obj:      s,
+			template: &s.Spec.Template,
+			patch: func(data []byte) error {
+				_, err := r.statefulSetGetter.StatefulSets(ns).Patch(name, types.StrategicMergePatchType, data)
+				return err
+			},
+		})
+	}
+	return workloads, nil
+}
+
+// secretsUsedBy returns the names of the secrets a pod uses through env,
+// envFrom or volumes.  Image pull secrets don't count, pods that are already
+// running don't need them anymore.
+func secretsUsedBy(spec *apicorev1.PodSpec) sets.String {
+	names := sets.NewString()
+	for _, v := range spec.Volumes {
+		if v.Secret != nil {
+			names.Insert(v.Secret.SecretName)
+		}
+		if v.Projected != nil {
+			for _, source := range v.Projected.Sources {
+				if source.Secret != nil {
+					names.Insert(source.Secret.Name)
+				}
+			}
+		}
+	}
+	containers := append(append([]apicorev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				names.Insert(env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil {
+				names.Insert(envFrom.SecretRef.Name)
+			}
+		}
+	}
+	return names
+}
+
+// rolloutHash combines the hashes of the synced secrets in names.  Our cache
+// may not have seen the update we just made, so the hash of the secret that
+// changed is passed in.
+func (c *TGIKController) rolloutHash(kind *kindAdapter, ns string, names []string, changed, changedHash string) (string, error) {
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		hash := changedHash
+		if name != changed {
+			secret, err := kind.get(ns, name)
+			if err != nil {
+				return "", err
+			}
+			if secret == nil || !c.config.isOwnedCopy(secret) {
+				continue
+			}
+			hash = secret.GetAnnotations()[c.config.hashAnnotation()]
+		}
+		fmt.Fprintf(h, "%s=%s\n", name, hash)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// rollWorkloads rolls the workloads in namespace using the secret name,
+// which now has the given hash.  updated says whether we just wrote the
+// secret.
+func (c *TGIKController) rollWorkloads(l *structuredLogger, kind *kindAdapter, namespace *apicorev1.Namespace, name, hash string, updated bool) error {
+	if c.rollouts == nil || kind.Kind != "Secret" {
+		return nil
+	}
+	ns := namespace.Name
+	workloads, err := c.rollouts.list(ns)
+	if err != nil {
+		return fmt.Errorf("error listing workloads in %v: %v", ns, err)
+	}
+
+	annotation := c.config.rolloutHashAnnotation()
+	var errs []error
+	for _, w := range workloads {
+		used := secretsUsedBy(&w.template.Spec)
+		if !used.Has(name) {
+			continue
+		}
+		current, rolled := w.template.Annotations[annotation]
+		if !rolled && !updated && !c.rollouts.hasFailed(w) {
+			continue
+		}
+		want, err := c.rolloutHash(kind, ns, used.List(), name, hash)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if current == want {
+			continue
+		}
+
+		wl := l.with("workload", w.kind, "workload_name", w.obj.GetName())
+		if c.dryRun {
+			wl.info("would roll workload", "action", "rollout", "result", "dry-run")
+			continue
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]string{annotation: want},
+					},
+				},
+			},
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = w.patch(patch)
+		recordWrite(w.kind, "rollout", err)
+		logWrite(wl, "rollout", err)
+		c.rollouts.setFailed(w, err != nil)
+		if err != nil {
+			c.recorder.eventf(namespaceReference(namespace), apicorev1.EventTypeWarning, reasonSyncFailed, "Error rolling %v %v/%v for Secret %v: %v", w.kind, ns, w.obj.GetName(), name, err)
+			errs = append(errs, fmt.Errorf("error rolling %v %v/%v: %v", w.kind, ns, w.obj.GetName(), err))
+			continue
+		}
+		c.recorder.eventf(namespaceReference(namespace), apicorev1.EventTypeNormal, reasonRolledOut, "Rolled %v %v/%v, Secret %v changed", w.kind, ns, w.obj.GetName(), name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
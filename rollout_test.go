@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/rest"
+)
+
+func TestRollWorkloadsRetriesFailedRolls(t *testing.T) {
+	// Nothing listens there so every patch fails.
+	client := kubernetes.NewForConfigOrDie(&rest.Config{Host: "http://127.0.0.1:1"})
+	sharedInformers := informers.NewSharedInformerFactory(client, 0)
+	kinds, err := newKindAdapters(client, sharedInformers, []string{"Secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTGIKController(client, kinds, sharedInformers.Core().V1().Namespaces(), sharedInformers.Core().V1().ConfigMaps(), defaultSyncConfig())
+	c.enableRollouts(client, sharedInformers)
+	c.recorder = nil
+
+	deployment := &extensionsv1beta1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "team-a"},
+		Spec: extensionsv1beta1.DeploymentSpec{
+			Template: apicorev1.PodTemplateSpec{
+				Spec: apicorev1.PodSpec{
+					Volumes: []apicorev1.Volume{{
+						Name:         "db",
+						VolumeSource: apicorev1.VolumeSource{Secret: &apicorev1.SecretVolumeSource{SecretName: "db"}},
+					}},
+				},
+			},
+		},
+	}
+	if err := sharedInformers.Extensions().V1beta1().Deployments().Informer().GetIndexer().Add(deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	// A workload we never rolled is left alone until we update the secret.
+	if err := c.rollWorkloads(logger, kinds[0], ns, "db", "hash", false); err != nil {
+		t.Fatalf("rollWorkloads() without update = %v, want nil", err)
+	}
+	if err := c.rollWorkloads(logger, kinds[0], ns, "db", "hash", true); err == nil {
+		t.Fatal("rollWorkloads() after update succeeded, want patch error")
+	}
+	// The retry finds the secret up to date but must still try again.
+	if err := c.rollWorkloads(logger, kinds[0], ns, "db", "hash", false); err == nil {
+		t.Fatal("rollWorkloads() on retry skipped the workload that failed to roll")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// namespaceSelectorAnnotation lets a source object narrow down which of the
+// opted in namespaces it goes to with a label selector, for example
+// "team=payments,env in (prod,staging)".  Without it an object goes to every
+// opted in namespace.
+func (cfg *syncConfig) namespaceSelectorAnnotation() string {
+	return cfg.Annotation + "-namespace-selector"
+}
+
+// targetsNamespace decides if a source object should be copied into an
+// (already opted in) namespace.
+func (c *TGIKController) targetsNamespace(obj metav1.Object, ns *apicorev1.Namespace) bool {
+	if !c.config.hasSyncAnnotation(obj) {
+		return false
+	}
+	rawSelector, ok := obj.GetAnnotations()[c.config.namespaceSelectorAnnotation()]
+	if !ok {
+		return true
+	}
+	selector, err := labels.Parse(rawSelector)
+	if err != nil {
+		// A broken selector matches nothing.  Better to not hand the object
+		// out than to hand it to everybody.
+		runtime.HandleError(fmt.Errorf("invalid namespace selector on %v/%v: %v", obj.GetNamespace(), obj.GetName(), err))
+		return false
+	}
+	return selector.Matches(labels.Set(ns.Labels))
+}
+
+// getSourcesForNamespace returns the source objects of a kind that should be
+// copied into ns.  If several source namespaces have an object with the same
+// name that targets ns, the one from the namespace with the highest
+// precedence wins.  An object that doesn't target ns doesn't hide the ones
+// from lower precedence namespaces.
+func (c *TGIKController) getSourcesForNamespace(kind *kindAdapter, ns *apicorev1.Namespace) ([]syncObject, error) {
+	sourceNamespaces := c.config.sourceNamespaces()
+	seen := map[string]bool{}
+	var objs []syncObject
+	for i := len(sourceNamespaces) - 1; i >= 0; i-- {
+		srcObjs, err := c.getObjectsInNS(kind, sourceNamespaces[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range srcObjs {
+			if seen[obj.GetName()] || !c.targetsNamespace(obj, ns) {
+				continue
+			}
+			seen[obj.GetName()] = true
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+// getSource looks up a source object by name, honouring the precedence of
+// the source namespaces.  It returns nil if no source namespace has it.
+func (c *TGIKController) getSource(kind *kindAdapter, name string) (syncObject, error) {
+	sourceNamespaces := c.config.sourceNamespaces()
+	for i := len(sourceNamespaces) - 1; i >= 0; i-- {
+		obj, err := kind.get(sourceNamespaces[i], name)
+		if err != nil || obj != nil {
+			return obj, err
+		}
+	}
+	return nil, nil
+}
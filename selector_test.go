@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// Source namespaces for the precedence tests, lowest precedence first.
+var testSourceNamespaces = []string{"base", "overrides"}
+
+func newPrecedenceTestController(t *testing.T, objs ...interface{}) *TGIKController {
+	c, _ := newTestController(t, objs...)
+	c.config.SourceNamespaces = testSourceNamespaces
+	return c
+}
+
+func TestGetSourcesForNamespace(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := func(ns, name, selector string) *apicorev1.Secret {
+		s := &apicorev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   ns,
+				Annotations: map[string]string{cfg.Annotation: "true"},
+			},
+		}
+		if selector != "" {
+			s.Annotations[cfg.namespaceSelectorAnnotation()] = selector
+		}
+		return s
+	}
+	unannotated := src("overrides", "db", "")
+	delete(unannotated.Annotations, cfg.Annotation)
+	ns := &apicorev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Labels:      map[string]string{"team": "a"},
+			Annotations: map[string]string{cfg.Annotation: "true"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		objs []interface{}
+		// want maps the name of each source to its namespace.
+		want map[string]string
+	}{
+		{
+			name: "distinct names",
+			objs: []interface{}{src("base", "db", ""), src("overrides", "tls", "")},
+			want: map[string]string{"db": "base", "tls": "overrides"},
+		},
+		{
+			name: "later namespace wins",
+			objs: []interface{}{src("base", "db", ""), src("overrides", "db", "")},
+			want: map[string]string{"db": "overrides"},
+		},
+		{
+			name: "later namespace doesn't target ns",
+			objs: []interface{}{src("base", "db", ""), src("overrides", "db", "team=b")},
+			want: map[string]string{"db": "base"},
+		},
+		{
+			name: "later namespace selects ns",
+			objs: []interface{}{src("base", "db", "team=b"), src("overrides", "db", "team=a")},
+			want: map[string]string{"db": "overrides"},
+		},
+		{
+			name: "later namespace isn't annotated",
+			objs: []interface{}{src("base", "db", ""), unannotated},
+			want: map[string]string{"db": "base"},
+		},
+		{
+			name: "no namespace targets ns",
+			objs: []interface{}{src("base", "db", "team=b"), src("overrides", "db", "team=b")},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPrecedenceTestController(t, tt.objs...)
+			srcs, err := c.getSourcesForNamespace(c.kinds[0], ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, s := range srcs {
+				if _, ok := got[s.GetName()]; ok {
+					t.Errorf("%v returned twice", s.GetName())
+				}
+				got[s.GetName()] = s.GetNamespace()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sources = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSource(t *testing.T) {
+	secret := func(ns, name string) *apicorev1.Secret {
+		return &apicorev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}
+	}
+	c := newPrecedenceTestController(t, secret("base", "db"), secret("overrides", "db"), secret("base", "tls"))
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"db", "overrides"},
+		{"tls", "base"},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		obj, err := c.getSource(c.kinds[0], tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if obj != nil {
+			got = obj.GetNamespace()
+		}
+		if got != tt.want {
+			t.Errorf("getSource(%q) from %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicySourcesFollowPrecedence(t *testing.T) {
+	cfg := defaultSyncConfig()
+	secret := func(ns, name, password string) *apicorev1.Secret {
+		return &apicorev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Data:       map[string][]byte{"password": []byte(password)},
+		}
+	}
+	policy := &apicorev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "payments",
+			Namespace: cfg.SourceNamespace,
+			Labels:    map[string]string{cfg.policyLabel(): "true"},
+		},
+		Data: map[string]string{policySpecKey: "secrets: [db, tls]\nnamespaceSelector: team=a\n"},
+	}
+	// team-a isn't annotated, only the policy copies anything into it.
+	ns := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}}
+	c := newPrecedenceTestController(t,
+		secret("base", "db", "base"), secret("overrides", "db", "overrides"), secret("base", "tls", "base"), policy, ns)
+
+	desired, err := c.desiredObjectsIn(c.kinds[0], ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for name, d := range desired {
+		if d.err != nil {
+			t.Fatalf("copy %v: %v", name, d.err)
+		}
+		got[name] = string(d.obj.(*apicorev1.Secret).Data["password"])
+	}
+	if want := map[string]string{"db": "overrides", "tls": "base"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copies come from %v, want %v", got, want)
+	}
+}
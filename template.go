@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// Secrets annotated with
+//
+//	eightypercent.net/secretsync-template: "true"
+//
+// have every value rendered as a text/template for each target namespace, so
+// a source can hold something like
+//
+//	postgres://{{ .Namespace.Name }}@db.{{ .Namespace.Labels.region }}.example.com
+//
+// Referring to a label or annotation the namespace doesn't have is an error
+// rather than an empty string.  This holds for secrets copied by policies
+// too since it is a property of the content.
+func (cfg *syncConfig) templateAnnotation() string {
+	return cfg.Annotation + "-template"
+}
+
+func (cfg *syncConfig) isTemplate(obj metav1.Object) bool {
+	return obj.GetAnnotations()[cfg.templateAnnotation()] == "true"
+}
+
+// templateNamespace is what templates see as .Namespace.
+type templateNamespace struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+type templateData struct {
+	Namespace templateNamespace
+}
+
+func newTemplateData(ns *apicorev1.Namespace) templateData {
+	data := templateData{
+		Namespace: templateNamespace{
+			Name:        ns.Name,
+			Labels:      ns.Labels,
+			Annotations: ns.Annotations,
+		},
+	}
+	// A namespace without labels should fail the same way as one with
+	// labels but not the one asked for.
+	if data.Namespace.Labels == nil {
+		data.Namespace.Labels = map[string]string{}
+	}
+	if data.Namespace.Annotations == nil {
+		data.Namespace.Annotations = map[string]string{}
+	}
+	return data
+}
+
+// renderSecret renders every value of secret in place for ns.
+func renderSecret(secret *apicorev1.Secret, ns *apicorev1.Namespace) error {
+	data := newTemplateData(ns)
+
+	// Go through the keys in order so the same broken secret always
+	// complains about the same key.
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(string(secret.Data[key]))
+		if err != nil {
+			return fmt.Errorf("error parsing template in key %q: %v", key, err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			return fmt.Errorf("error rendering key %q for namespace %v: %v", key, ns.Name, err)
+		}
+		secret.Data[key] = out.Bytes()
+	}
+	return nil
+}
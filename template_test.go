@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestRenderSecret(t *testing.T) {
+	labelled := &apicorev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Labels:      map[string]string{"region": "eu"},
+			Annotations: map[string]string{"owner": "alice"},
+		},
+	}
+	bare := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}}
+
+	tests := []struct {
+		name    string
+		ns      *apicorev1.Namespace
+		data    map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "plain values are left alone",
+			ns:   labelled,
+			data: map[string]string{"password": "hunter2"},
+			want: map[string]string{"password": "hunter2"},
+		},
+		{
+			name: "name, label and annotation",
+			ns:   labelled,
+			data: map[string]string{
+				"url":   "postgres://{{ .Namespace.Name }}@db.{{ .Namespace.Labels.region }}.example.com",
+				"owner": "{{ .Namespace.Annotations.owner }}",
+			},
+			want: map[string]string{
+				"url":   "postgres://team-a@db.eu.example.com",
+				"owner": "alice",
+			},
+		},
+		{
+			name:    "missing label",
+			ns:      labelled,
+			data:    map[string]string{"url": "{{ .Namespace.Labels.zone }}"},
+			wantErr: true,
+		},
+		{
+			name:    "missing label on a namespace without labels",
+			ns:      bare,
+			data:    map[string]string{"url": "{{ .Namespace.Labels.region }}"},
+			wantErr: true,
+		},
+		{
+			name:    "missing annotation on a namespace without annotations",
+			ns:      bare,
+			data:    map[string]string{"owner": "{{ .Namespace.Annotations.owner }}"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			ns:      labelled,
+			data:    map[string]string{"url": "{{ .Cluster }}"},
+			wantErr: true,
+		},
+		{
+			name:    "syntax error",
+			ns:      labelled,
+			data:    map[string]string{"url": "{{ .Namespace.Name"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &apicorev1.Secret{Data: map[string][]byte{}}
+			for k, v := range tt.data {
+				secret.Data[k] = []byte(v)
+			}
+			err := renderSecret(secret, tt.ns)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("renderSecret() succeeded with %q", secret.Data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderSecret() failed: %v", err)
+			}
+			for k, want := range tt.want {
+				if got := string(secret.Data[k]); got != want {
+					t.Errorf("key %q = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderSecretReportsFirstBrokenKey(t *testing.T) {
+	ns := &apicorev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	secret := &apicorev1.Secret{Data: map[string][]byte{
+		"b": []byte("{{ .Namespace.Labels.x }}"),
+		"a": []byte("{{ .Namespace.Labels.y }}"),
+		"c": []byte("{{ .Namespace.Labels.z }}"),
+	}}
+	// Retries of a broken secret should always complain about the same key.
+	for i := 0; i < 10; i++ {
+		err := renderSecret(secret, ns)
+		if err == nil {
+			t.Fatal("renderSecret() succeeded")
+		}
+		if want := `error rendering key "a" for namespace team-a`; !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("renderSecret() = %v, want it to start with %q", err, want)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/jbeda/tgik-controller/version"
@@ -15,12 +17,120 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// Exit codes.  Being killed by a second signal exits with 128 plus the
+// signal number like a shell would report.
+const (
+	exitOK = 0
+	// exitError covers bad flags and config, startup failures and losing
+	// the leader lease.
+	exitError = 1
+	// exitShutdownTimeout means workers were still busy when the shutdown
+	// grace period ran out.
+	exitShutdownTimeout = 3
+)
+
 func main() {
-	log.Printf("tgik-controller version %s", version.VERSION)
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(runPlan(os.Args[2:]))
+	}
 
+	var logFlags logFlags
+	addLogFlags(flag.CommandLine, &logFlags)
 	kubeconfig := ""
 	flag.StringVar(&kubeconfig, "kubeconfig", kubeconfig, "kubeconfig file")
+	httpAddress := ":8080"
+	flag.StringVar(&httpAddress, "http-address", httpAddress, "address to serve /metrics, /healthz and /readyz on; empty to disable")
+	workers := 1
+	flag.IntVar(&workers, "workers", workers, "number of items to sync in parallel")
+	shutdownGracePeriod := defaultShutdownGracePeriod
+	flag.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", shutdownGracePeriod, "how long workers get to finish their current item on SIGTERM or SIGINT; with --leader-elect it must be shorter than the lease duration minus the renew deadline, and defaults to that minus the retry period")
+	stuckWorkerThreshold := defaultStuckWorkerThreshold
+	flag.DurationVar(&stuckWorkerThreshold, "stuck-worker-threshold", stuckWorkerThreshold, "fail /healthz if a worker spends longer than this on one item")
+
+	webhook := webhookConfig{}
+	flag.StringVar(&webhook.Address, "webhook-address", webhook.Address, "address to serve the admission webhook rejecting edits of managed copies on, e.g. :8443; empty to disable")
+	flag.StringVar(&webhook.CertDir, "webhook-cert-dir", webhook.CertDir, "directory with tls.crt and tls.key for the webhook; a self-signed pair is generated (and written there) if they're missing")
+	flag.StringVar(&webhook.Host, "webhook-host", webhook.Host, "host name for the generated webhook certificate; defaults to tgik-controller.<source namespace>.svc")
+	flag.StringVar(&webhook.AllowedUser, "webhook-allowed-user", webhook.AllowedUser, "user allowed to update managed copies; defaults to the service account the controller runs as")
+
+	dryRun := false
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "don't write anything to the cluster, just log the creates, updates and deletes that would happen")
+
+	leaderElect := false
+	hostname, _ := os.Hostname()
+	leaderElection := leaderElectionConfig{
+		Name:          "tgik-controller",
+		Identity:      hostname,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+	flag.BoolVar(&leaderElect, "leader-elect", leaderElect, "only run the controller while holding a leader lease, so multiple replicas can run at once")
+	flag.StringVar(&leaderElection.Namespace, "leader-elect-namespace", leaderElection.Namespace, "namespace of the ConfigMap holding the leader lease; defaults to the source namespace")
+	flag.StringVar(&leaderElection.Name, "leader-elect-name", leaderElection.Name, "name of the ConfigMap holding the leader lease")
+	flag.StringVar(&leaderElection.Identity, "leader-elect-identity", leaderElection.Identity, "identity written into the leader lease; must be unique per replica")
+	flag.DurationVar(&leaderElection.LeaseDuration, "leader-elect-lease-duration", leaderElection.LeaseDuration, "how long other replicas wait before taking over a lease that isn't renewed")
+	flag.DurationVar(&leaderElection.RenewDeadline, "leader-elect-renew-deadline", leaderElection.RenewDeadline, "how long the leader retries renewing before it steps down")
+	flag.DurationVar(&leaderElection.RetryPeriod, "leader-elect-retry-period", leaderElection.RetryPeriod, "how long to wait between leader election attempts")
+
+	syncConfigFile := ""
+	flag.StringVar(&syncConfigFile, "config", syncConfigFile, "YAML or JSON file with the sync configuration; flags override it")
+	syncConfig := defaultSyncConfig()
+	addSyncConfigFlags(flag.CommandLine, &syncConfig)
+
 	flag.Parse()
+	if syncConfigFile != "" {
+		if err := loadSyncConfigFile(syncConfigFile, &syncConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %v", err)
+			os.Exit(exitError)
+		}
+		// Parse again so anything given on the command line wins over the
+		// file.
+		flag.Parse()
+	}
+	if err := setupLogger(logFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid logging flags: %v", err)
+		os.Exit(exitError)
+	}
+	logger.info("starting", "version", version.VERSION)
+	if err := syncConfig.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v", err)
+		os.Exit(exitError)
+	}
+	if workers < 1 {
+		fmt.Fprintf(os.Stderr, "--workers must be at least 1")
+		os.Exit(exitError)
+	}
+	if dryRun && leaderElect {
+		fmt.Fprintf(os.Stderr, "--dry-run can't be combined with --leader-elect, the lease is a write")
+		os.Exit(exitError)
+	}
+	if leaderElect {
+		// Workers finishing up hold on to a lease we no longer renew, so
+		// they have to be done before another replica can take it over.
+		graceSet := false
+		flag.Visit(func(f *flag.Flag) {
+			graceSet = graceSet || f.Name == "shutdown-grace-period"
+		})
+		if !graceSet {
+			shutdownGracePeriod = leaderElection.LeaseDuration - leaderElection.RenewDeadline - leaderElection.RetryPeriod
+		}
+		if err := validateShutdownGracePeriod(shutdownGracePeriod, leaderElection); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid leader election flags: %v", err)
+			os.Exit(exitError)
+		}
+	}
+	if shutdownGracePeriod <= 0 {
+		fmt.Fprintf(os.Stderr, "--shutdown-grace-period must be positive")
+		os.Exit(exitError)
+	}
+	if leaderElection.Namespace == "" {
+		leaderElection.Namespace = syncConfig.SourceNamespace
+	}
+	if webhook.Host == "" {
+		webhook.Host = "tgik-controller." + syncConfig.SourceNamespace + ".svc"
+	}
+
 	if kubeconfig == "" {
 		kubeconfig = os.Getenv("KUBECONFIG")
 	}
@@ -35,13 +145,96 @@ func main() {
 	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error creating client: %v", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	client := kubernetes.NewForConfigOrDie(config)
 
 	sharedInformers := informers.NewSharedInformerFactory(client, 10*time.Minute)
-	tgikController := NewTGIKController(client, sharedInformers.Core().V1().Secrets(), sharedInformers.Core().V1().Namespaces())
+	kinds, err := newKindAdapters(client, sharedInformers, syncConfig.Kinds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v", err)
+		os.Exit(exitError)
+	}
+	tgikController := NewTGIKController(client, kinds, sharedInformers.Core().V1().Namespaces(), sharedInformers.Core().V1().ConfigMaps(), syncConfig)
+	tgikController.health.stuckThreshold = stuckWorkerThreshold
+	tgikController.shutdownGracePeriod = shutdownGracePeriod
+	if syncConfig.RolloutOnChange {
+		tgikController.enableRollouts(client, sharedInformers)
+	}
+	if dryRun {
+		logger.info("dry-run mode, nothing will be written to the cluster")
+		tgikController.enableDryRun(newPlanWriter(&tgikController.config))
+	}
+
+	if httpAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		mux.HandleFunc("/healthz", tgikController.health.ServeHealthz)
+		mux.HandleFunc("/readyz", tgikController.health.ServeReadyz)
+		go func() {
+			logger.info("serving http", "address", httpAddress)
+			err := http.ListenAndServe(httpAddress, mux)
+			logger.fatal("error serving http", "err", err)
+		}()
+	}
+	if webhook.Address != "" {
+		go func() {
+			err := serveWebhook(webhook, &tgikController.config)
+			logger.fatal("error serving admission webhook", "err", err)
+		}()
+	}
+
+	stop := make(chan struct{})
+	go handleSignals(stop)
 
-	sharedInformers.Start(nil)
-	tgikController.Run(nil)
+	sharedInformers.Start(stop)
+	if !leaderElect {
+		os.Exit(shutdownExitCode(tgikController.Run(workers, stop)))
+	}
+
+	elector, err := newLeaderElector(client.CoreV1(), leaderElection)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up leader election: %v", err)
+		os.Exit(exitError)
+	}
+	// Become ready as soon as our caches are, leader or not.  Otherwise a
+	// rolling update waits forever on a new replica that can't get the
+	// lease while the old one still holds it.
+	if !tgikController.waitForCacheSync(stop) {
+		os.Exit(shutdownExitCode(nil))
+	}
+	var runErr error
+	lost := elector.Run(stop, func(leaderStop <-chan struct{}) {
+		runErr = tgikController.Run(workers, leaderStop)
+	})
+	if lost {
+		// Exit right away, without waiting for workers, so nothing we do
+		// can race with the next leader.  We get restarted and go back to
+		// being a candidate with fresh caches.
+		logger.fatal("lost leader lease")
+	}
+	// We were asked to stop and the lease has been released.
+	os.Exit(shutdownExitCode(runErr))
+}
+
+// handleSignals closes stop on the first SIGTERM or SIGINT.  A second one
+// means somebody is tired of waiting, so we exit right away.
+func handleSignals(stop chan struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logger.info("shutting down", "signal", sig)
+	close(stop)
+	sig = <-signals
+	logger.warn("exiting without waiting for workers", "signal", sig)
+	os.Exit(128 + int(sig.(syscall.Signal)))
+}
+
+func shutdownExitCode(err error) int {
+	if err != nil {
+		logger.error("unclean shutdown", "err", err)
+		return exitShutdownTimeout
+	}
+	logger.info("shut down cleanly")
+	return exitOK
 }
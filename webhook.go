@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authenticationv1 "k8s.io/client-go/pkg/apis/authentication/v1"
+	"k8s.io/client-go/util/cert"
+)
+
+// The controller overwrites any change to a copy on its next sync, which
+// surprises people who `kubectl edit` one.  With --webhook-address we serve
+// a validating admission webhook that rejects updates to copies we manage
+// unless they come from the controller itself.  The webhook has to be
+// registered with a ValidatingWebhookConfiguration for UPDATE of the kinds
+// we replicate, pointing at /validate.
+//
+// The API server only talks TLS to webhooks.  Without a certificate in
+// --webhook-cert-dir we generate a self-signed one and log it, as the
+// configuration needs it in its caBundle.
+
+const (
+	webhookPath     = "/validate"
+	webhookCertFile = "tls.crt"
+	webhookKeyFile  = "tls.key"
+
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// The vendored client-go predates admission.k8s.io so these are just the
+// parts of AdmissionReview we use.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *admissionRequest  `json:"request,omitempty"`
+	Response        *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string                    `json:"uid"`
+	Kind      metav1.GroupVersionKind   `json:"kind"`
+	Namespace string                    `json:"namespace,omitempty"`
+	Name      string                    `json:"name,omitempty"`
+	Operation string                    `json:"operation"`
+	UserInfo  authenticationv1.UserInfo `json:"userInfo"`
+	// Object is what the update would leave.  review only trusts OldObject:
+	// the update may well have dropped our annotations from Object.
+	Object    json.RawMessage `json:"object,omitempty"`
+	OldObject json.RawMessage `json:"oldObject,omitempty"`
+}
+
+type admissionResponse struct {
+	UID     string         `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+type webhookConfig struct {
+	Address string
+	// CertDir holds tls.crt and tls.key.  If they aren't there we generate
+	// them, and write them there if CertDir is set.
+	CertDir string
+	// Host is the name the API server uses to reach us.  It goes into the
+	// generated certificate.
+	Host string
+	// AllowedUser may edit copies.  It defaults to our own service account.
+	AllowedUser string
+}
+
+// admissionWebhook decides whether an update to an object is allowed.
+type admissionWebhook struct {
+	config      *syncConfig
+	allowedUser string
+}
+
+func (w *admissionWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		admissionCount.inc("error")
+		http.Error(rw, fmt.Sprintf("expected an AdmissionReview request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response := w.review(review.Request)
+	response.UID = review.Request.UID
+	review.Request = nil
+	review.Response = response
+	raw, err := json.Marshal(review)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(raw)
+}
+
+// review only ever denies updates of copies we own.  Everything else,
+// including requests it can't make sense of, is let through so a broken
+// webhook doesn't lock people out of their namespaces.
+func (w *admissionWebhook) review(req *admissionRequest) *admissionResponse {
+	l := logger.with("webhook", req.UID, "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "user", req.UserInfo.Username)
+	allow := &admissionResponse{Allowed: true}
+	if req.Operation != "UPDATE" || req.UserInfo.Username == w.allowedUser {
+		admissionCount.inc("allowed")
+		return allow
+	}
+
+	// Look at the old object, see admissionRequest.
+	var old struct {
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(req.OldObject, &old); err != nil {
+		l.warn("can't decode old object, allowing update", "err", err)
+		admissionCount.inc("error")
+		return allow
+	}
+	if !w.config.isOwnedCopy(&old) {
+		admissionCount.inc("allowed")
+		return allow
+	}
+
+	source := fmt.Sprintf("%v/%v", old.Annotations[w.config.sourceNamespaceAnnotation()], old.Annotations[w.config.sourceNameAnnotation()])
+	l.info("denied edit of managed copy", "source", source)
+	admissionCount.inc("denied")
+	return &admissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf("%v %v/%v is managed by %v, edit its source %v instead", req.Kind.Kind, req.Namespace, req.Name, controllerName, source),
+		},
+	}
+}
+
+// serveWebhook serves the webhook over TLS until it fails.
+func serveWebhook(wc webhookConfig, config *syncConfig) error {
+	allowedUser := wc.AllowedUser
+	if allowedUser == "" {
+		var err error
+		allowedUser, err = serviceAccountUsername(serviceAccountTokenFile)
+		if err != nil {
+			return fmt.Errorf("can't tell which user the controller runs as, set --webhook-allowed-user: %v", err)
+		}
+	}
+	certPEM, keyPEM, err := loadOrGenerateWebhookCert(wc)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(webhookPath, &admissionWebhook{config: config, allowedUser: allowedUser})
+	server := &http.Server{
+		Addr:      wc.Address,
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+	}
+	logger.info("serving admission webhook", "address", wc.Address, "path", webhookPath, "allowed_user", allowedUser)
+	return server.ListenAndServeTLS("", "")
+}
+
+// loadOrGenerateWebhookCert returns the PEM encoded certificate and key for
+// the webhook.
+func loadOrGenerateWebhookCert(wc webhookConfig) ([]byte, []byte, error) {
+	certPath := filepath.Join(wc.CertDir, webhookCertFile)
+	keyPath := filepath.Join(wc.CertDir, webhookKeyFile)
+	if wc.CertDir != "" {
+		ok, err := cert.CanReadCertAndKey(certPath, keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			certPEM, err := ioutil.ReadFile(certPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyPEM, err := ioutil.ReadFile(keyPath)
+			return certPEM, keyPEM, err
+		}
+	}
+
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey(wc.Host, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating webhook certificate: %v", err)
+	}
+	if wc.CertDir != "" {
+		if err := cert.WriteCert(certPath, certPEM); err != nil {
+			return nil, nil, err
+		}
+		if err := cert.WriteKey(keyPath, keyPEM); err != nil {
+			return nil, nil, err
+		}
+	}
+	// The certificate is its own CA so it is also what goes into caBundle.
+	logger.info("generated self-signed webhook certificate", "host", wc.Host, "ca_bundle", base64.StdEncoding.EncodeToString(certPEM))
+	return certPEM, keyPEM, nil
+}
+
+// serviceAccountUsername reads the username of the service account we run
+// as from the "sub" claim of its token.
+func serviceAccountUsername(tokenFile string) (string, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(strings.TrimSpace(string(token)), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%v isn't a JWT", tokenFile)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("error decoding %v: %v", tokenFile, err)
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("error decoding %v: %v", tokenFile, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%v has no subject", tokenFile)
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apicorev1 "k8s.io/client-go/pkg/api/v1"
+	authenticationv1 "k8s.io/client-go/pkg/apis/authentication/v1"
+)
+
+const testControllerUser = "system:serviceaccount:secretsync:tgik-controller"
+
+func webhookSecret(t *testing.T, annotations map[string]string) json.RawMessage {
+	raw, err := json.Marshal(&apicorev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "team-a",
+			Annotations: annotations,
+		},
+		Data: map[string][]byte{"password": []byte("hunter2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestAdmissionWebhookReview(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: cfg.SourceNamespace, UID: "uid-db"}}
+	owned := map[string]string{cfg.Annotation: "true"}
+	cfg.stampProvenance(&metav1.ObjectMeta{Annotations: owned}, src)
+	w := &admissionWebhook{config: &cfg, allowedUser: testControllerUser}
+
+	tests := []struct {
+		name      string
+		operation string
+		user      string
+		object    json.RawMessage
+		oldObject json.RawMessage
+		want      bool
+	}{
+		{
+			name:      "delete",
+			operation: "DELETE",
+			user:      "alice",
+			oldObject: webhookSecret(t, owned),
+			want:      true,
+		},
+		{
+			name:      "update by the controller",
+			operation: "UPDATE",
+			user:      testControllerUser,
+			oldObject: webhookSecret(t, owned),
+			want:      true,
+		},
+		{
+			name:      "update of an object we don't own",
+			operation: "UPDATE",
+			user:      "alice",
+			oldObject: webhookSecret(t, map[string]string{cfg.Annotation: "true"}),
+			want:      true,
+		},
+		{
+			name:      "update of a managed copy",
+			operation: "UPDATE",
+			user:      "alice",
+			object:    webhookSecret(t, owned),
+			oldObject: webhookSecret(t, owned),
+			want:      false,
+		},
+		{
+			name:      "update that removes our annotations",
+			operation: "UPDATE",
+			user:      "alice",
+			object:    webhookSecret(t, nil),
+			oldObject: webhookSecret(t, owned),
+			want:      false,
+		},
+		{
+			name:      "old object can't be decoded",
+			operation: "UPDATE",
+			user:      "alice",
+			oldObject: json.RawMessage(`"not an object"`),
+			want:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := w.review(&admissionRequest{
+				UID:       "uid-review",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+				Namespace: "team-a",
+				Name:      "db",
+				Operation: tt.operation,
+				UserInfo:  authenticationv1.UserInfo{Username: tt.user},
+				Object:    tt.object,
+				OldObject: tt.oldObject,
+			})
+			if resp.Allowed != tt.want {
+				t.Errorf("Allowed = %v, want %v", resp.Allowed, tt.want)
+			}
+			if !resp.Allowed && (resp.Result == nil || resp.Result.Code != http.StatusForbidden) {
+				t.Errorf("denial has result %+v, want code %v", resp.Result, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestAdmissionWebhookServeHTTP(t *testing.T) {
+	cfg := defaultSyncConfig()
+	src := &apicorev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: cfg.SourceNamespace, UID: "uid-db"}}
+	owned := map[string]string{cfg.Annotation: "true"}
+	cfg.stampProvenance(&metav1.ObjectMeta{Annotations: owned}, src)
+	w := &admissionWebhook{config: &cfg, allowedUser: testControllerUser}
+
+	body, err := json.Marshal(admissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &admissionRequest{
+			UID:       "705ab4f5-6393-11e8-b7cc-42010a800002",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Namespace: "team-a",
+			Name:      "db",
+			Operation: "UPDATE",
+			UserInfo:  authenticationv1.UserInfo{Username: "alice"},
+			Object:    webhookSecret(t, owned),
+			OldObject: webhookSecret(t, owned),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, webhookPath, bytes.NewReader(body)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var review admissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Kind != "AdmissionReview" || review.Request != nil || review.Response == nil {
+		t.Fatalf("got review %+v, want an AdmissionReview with only a response", review)
+	}
+	if review.Response.UID != "705ab4f5-6393-11e8-b7cc-42010a800002" {
+		t.Errorf("response UID = %q, want the request UID", review.Response.UID)
+	}
+	if review.Response.Allowed {
+		t.Errorf("edit of a managed copy was allowed")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// objectWriter is where the controller sends its writes to copies.  Normally
+// that is the API server but with --dry-run they only get written down.
+type objectWriter interface {
+	create(kind *kindAdapter, obj syncObject) error
+	update(kind *kindAdapter, obj syncObject) error
+	delete(kind *kindAdapter, ns, name string) error
+}
+
+// apiWriter writes to the API server.
+type apiWriter struct{}
+
+func (apiWriter) create(kind *kindAdapter, obj syncObject) error {
+	err := kind.create(obj)
+	recordWrite(kind.Kind, "create", err)
+	return err
+}
+
+func (apiWriter) update(kind *kindAdapter, obj syncObject) error {
+	err := kind.update(obj)
+	recordWrite(kind.Kind, "update", err)
+	return err
+}
+
+func (apiWriter) delete(kind *kindAdapter, ns, name string) error {
+	err := kind.delete(ns, name)
+	recordWrite(kind.Kind, "delete", err)
+	return err
+}
+
+// planEntry is one action in a dry-run plan.  It never includes the content
+// of the object.
+type planEntry struct {
+	Action    string   `json:"action"`
+	Kind      string   `json:"kind"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Sources   []string `json:"sources,omitempty"`
+	Policy    string   `json:"policy,omitempty"`
+	// Hash is the content hash the copy would get.  It tells apart updates
+	// planned for different versions of the same source.
+	Hash string `json:"hash,omitempty"`
+}
+
+// planWriter records writes instead of doing them.  Nothing we "write" shows
+// up in the informer caches so every resync would plan the same actions
+// again.  Only new or changed actions get logged.
+type planWriter struct {
+	config *syncConfig
+
+	mu sync.Mutex
+	// planned maps kind/namespace/name to the last entry logged for it.
+	planned map[string]planEntry
+}
+
+func newPlanWriter(config *syncConfig) *planWriter {
+	return &planWriter{
+		config:  config,
+		planned: map[string]planEntry{},
+	}
+}
+
+func (w *planWriter) create(kind *kindAdapter, obj syncObject) error {
+	w.record(w.entry("create", kind, obj))
+	return nil
+}
+
+func (w *planWriter) update(kind *kindAdapter, obj syncObject) error {
+	w.record(w.entry("update", kind, obj))
+	return nil
+}
+
+func (w *planWriter) delete(kind *kindAdapter, ns, name string) error {
+	w.record(planEntry{
+		Action:    "delete",
+		Kind:      kind.Kind,
+		Namespace: ns,
+		Name:      name,
+	})
+	return nil
+}
+
+func (w *planWriter) entry(action string, kind *kindAdapter, obj syncObject) planEntry {
+	annotations := obj.GetAnnotations()
+	namespaces := splitList(annotations[w.config.sourceNamespaceAnnotation()])
+	names := w.config.copySourceNames(obj)
+	var sources []string
+	for i, name := range names {
+		// Plain copies have one source namespace, composites one per
+		// contributor.
+		ns := ""
+		if len(namespaces) == 1 {
+			ns = namespaces[0]
+		} else if i < len(namespaces) {
+			ns = namespaces[i]
+		}
+		sources = append(sources, ns+"/"+name)
+	}
+	return planEntry{
+		Action:    action,
+		Kind:      kind.Kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Sources:   sources,
+		Policy:    annotations[w.config.policyAnnotation()],
+		Hash:      annotations[w.config.hashAnnotation()],
+	}
+}
+
+func (w *planWriter) record(entry planEntry) {
+	key := entry.Kind + "/" + entry.Namespace + "/" + entry.Name
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if last, ok := w.planned[key]; ok && last.Action == entry.Action && last.Hash == entry.Hash {
+		return
+	}
+	w.planned[key] = entry
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		logger.error("error encoding plan entry", "key", key, "err", err)
+		return
+	}
+	logger.info("dry-run plan", "entry", string(raw))
+}